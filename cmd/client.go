@@ -3,17 +3,30 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/lachlan2k/dns-tunnel/internal/client"
+	"github.com/lachlan2k/dns-tunnel/internal/request"
 )
 
 func main() {
 	tunnelDomain := flag.String("domain", "tunnel.local", "Domain to tunnel over")
 	listenAddr := flag.String("listenAddr", "127.0.0.1:4321", "Local port to listen on")
 	dialAddr := flag.String("dialAddr", "127.0.0.1:51820", "Remote address to dial")
-	resolver := flag.String("resolver", "8.8.8.8", "DNS resolver to use")
+	resolvers := flag.String("resolver", "8.8.8.8", "Comma-separated DNS resolvers to use (host[:port], or tcp://, tls:// or https:// URL)")
+	resolvConf := flag.String("resolvConf", "", "Also use the resolvers listed in this file (e.g. /etc/resolv.conf)")
+	dohMethod := flag.String("dohMethod", "POST", "HTTP method for DNS-over-HTTPS resolvers (GET or POST)")
 	psk := flag.String("psk", "hunter2", "Pre-shared key for symmetric encryption")
+	keyName := flag.String("keyName", request.DEFAULT_KEY_NAME, "Name of the pre-shared key, if the server has a key file")
 	threads := flag.Int("threads", 10, "How many reader/writer threads to use")
+	ednsSize := flag.Uint("ednsSize", 1232, "EDNS0 UDP size to advertise, which caps the size of responses (512 to disable EDNS0)")
+	fecRatio := flag.Float64("fec", 0, "Parity fragments to send per data fragment for forward error correction, raised automatically on lossy paths (0 to disable, max 1)")
+	pollWait := flag.Duration("pollWait", 1500*time.Millisecond, "How long the server may hold a poll open waiting for data (at most 2.5s, half the client's query timeout)")
+	natTimeout := flag.Duration("natTimeout", 3*time.Minute, "Close the session for a local address that hasn't sent or received anything for this long")
+	encrypt := flag.Bool("encrypt", false, "Encrypt data on the wire, for protocols that don't encrypt their own (costs 16 bytes per query and 16 per response)")
+	pskOnly := flag.Bool("pskOnly", false, "Open sessions with the pre-shared key alone, for servers without handshake support (no forward secrecy)")
+	recordType := flag.String("recordType", "TXT", "DNS record type to carry responses (TXT, CNAME, MX, SRV, NULL, A, AAAA)")
 
 	flag.Parse()
 
@@ -21,9 +34,19 @@ func main() {
 		ListenAddr:   *listenAddr,
 		DialAddr:     *dialAddr,
 		TunnelDomain: *tunnelDomain,
-		Resolver:     *resolver,
+		Resolvers:    splitList(*resolvers),
+		ResolvConf:   *resolvConf,
 		PSK:          *psk,
 		Threads:      *threads,
+		RecordType:   *recordType,
+		EDNSSize:     uint16(*ednsSize),
+		DoHMethod:    *dohMethod,
+		FECRatio:     *fecRatio,
+		PollWait:     *pollWait,
+		NATTimeout:   *natTimeout,
+		Encrypt:      *encrypt,
+		PSKOnly:      *pskOnly,
+		KeyName:      *keyName,
 	})
 
 	err := c.Run()
@@ -32,3 +55,13 @@ func main() {
 		log.Fatalf("Couldn't start client: %v", err)
 	}
 }
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/lachlan2k/dns-tunnel/internal/server"
 )
@@ -12,16 +13,32 @@ func main() {
 	listenAddr := flag.String("listenAddr", "127.0.0.1:5432", "Local port to listen on")
 	nameserver := flag.String("nameserver", "ns1.tunnel.local", "NS record to respond with")
 	psk := flag.String("psk", "hunter2", "Pre-shared key for symmetric encryption")
+	pskFile := flag.String("pskFile", "", "File of named pre-shared keys, one \"name passphrase\" per line, used instead of -psk (reloaded on SIGHUP)")
+	aclFile := flag.String("acl", "", "File of rules for where clients may ask to dial, one \"allow|deny [key=name,...] target\" per line (reloaded on SIGHUP)")
+	auditLog := flag.String("auditLog", "", "File to write access decisions to (defaults to the main log)")
 	pollOnWrite := flag.Bool("pollOnWrite", true, "Whether to automatically poll on write requests too")
+	maxUDPSize := flag.Int("maxUDPSize", 4096, "Largest UDP response to send, even if resolvers advertise more with EDNS0")
+	maxPollWait := flag.Duration("maxPollWait", 2*time.Second, "Longest to hold a poll open waiting for data (keep it under resolver timeouts)")
+	sessionTimeout := flag.Duration("sessionTimeout", 2*time.Minute, "Close sessions that haven't been polled or written to for this long")
+	queueDepth := flag.Int("queueDepth", 256, "How many downstream fragments to buffer per session while waiting for polls")
+	dropPolicy := flag.String("dropPolicy", "oldest", "What to drop when a session's queue is full (oldest, newest, or datagram for whole datagrams)")
 
 	flag.Parse()
 
 	s := server.NewFromConfig(server.Config{
-		ListenAddr:   *listenAddr,
-		TunnelDomain: *tunnelDomain,
-		Nameserver:   *nameserver,
-		PSK:          *psk,
-		PollOnWrite:  *pollOnWrite,
+		ListenAddr:     *listenAddr,
+		TunnelDomain:   *tunnelDomain,
+		Nameserver:     *nameserver,
+		PSK:            *psk,
+		PSKFile:        *pskFile,
+		ACLFile:        *aclFile,
+		AuditLog:       *auditLog,
+		PollOnWrite:    *pollOnWrite,
+		MaxUDPSize:     *maxUDPSize,
+		MaxPollWait:    *maxPollWait,
+		SessionTimeout: *sessionTimeout,
+		QueueDepth:     *queueDepth,
+		DropPolicy:     *dropPolicy,
 	})
 
 	err := s.Run()
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// Keeps track of which downstream fragments we've received, so we can ack them and drop duplicates
+type ackTracker struct {
+	lock   sync.Mutex
+	next   uint32
+	bitmap uint32 // bit i is set if we've received next+1+i
+}
+
+// Records seq as received, returning false if we've already seen it
+func (t *ackTracker) receive(seq uint32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	offset := seq - t.next
+
+	switch {
+	case int32(offset) < 0:
+		return false
+
+	case offset == 0:
+		// Slide the window along past everything we've got
+		t.next++
+		for t.bitmap&1 != 0 {
+			t.next++
+			t.bitmap >>= 1
+		}
+		t.bitmap >>= 1
+
+	case offset <= request.DOWNSTREAM_WINDOW:
+		bit := uint32(1) << (offset - 1)
+		if t.bitmap&bit != 0 {
+			return false
+		}
+		t.bitmap |= bit
+	}
+
+	// Anything past the window shouldn't happen, as the server won't send that far ahead.
+	// If it does, we take it, and it may turn up again when the server resends it.
+	return true
+}
+
+func (t *ackTracker) ack() request.DownstreamAck {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return request.DownstreamAck{
+		Next:   t.next,
+		Bitmap: t.bitmap,
+	}
+}
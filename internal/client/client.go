@@ -1,9 +1,16 @@
 package client
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
+	"github.com/lachlan2k/dns-tunnel/internal/records"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 	"github.com/miekg/dns"
 )
@@ -12,25 +19,153 @@ type Config struct {
 	ListenAddr   string
 	DialAddr     string
 	TunnelDomain string
-	Resolver     string
+	Resolvers    []string
+	ResolvConf   string
 	PSK          string
 	Threads      int
+	RecordType   string
+	EDNSSize     uint16
+	DoHMethod    string
+	// Parity fragments to send per data fragment, in both directions (0 to disable FEC).
+	// Each side sends more than this when it sees fragments going missing.
+	FECRatio float64
+	// How long the server may hold a poll open waiting for data (it caps this itself too)
+	PollWait time.Duration
+	// How long a local address can go without a datagram either way before we close its session
+	NATTimeout time.Duration
+	// Whether to encrypt data (writes and poll responses), for protocols that don't do it themselves
+	Encrypt bool
+	// Open sessions by sending the secret under the PSK, rather than with a handshake, for servers that don't do handshakes
+	PSKOnly bool
+	// Which of the server's keys PSK is
+	KeyName string
 }
 
 type Client struct {
+	// These two are first, so they're 64-bit aligned for atomics on 32-bit platforms.
+	// Counts our control messages, for the server's replay window.
+	controlCounter uint64
+	// How far ahead of ours the server's clock is, in nanoseconds (see syncClock)
+	clockOffset int64
+	// Random, so the server can keep our counter apart from other clients'
+	clientID    uint64
 	config      Config
 	conn        *net.UDPConn
 	requestSize int
+	recordType  uint16
+	codec       records.RecordCodec
+	resolvers   *resolverPool
+	dataNonce   uint32
+	key         *request.Key
 }
 
 func NewFromConfig(config Config) Client {
+	var nonceStart [4]byte
+	rand.Read(nonceStart[:])
+
+	var clientID [8]byte
+	rand.Read(clientID[:])
+
 	return Client{
+		clientID:    binary.BigEndian.Uint64(clientID[:]),
 		config:      config,
-		requestSize: request.GetMaxRequestSize(dns.Fqdn(config.TunnelDomain)),
+		requestSize: request.GetMaxRequestSize(dns.Fqdn(config.TunnelDomain), config.Encrypt),
+		dataNonce:   binary.BigEndian.Uint32(nonceStart[:]),
+	}
+}
+
+// Counts up, so no two data messages in a row have the same name
+func (c *Client) nextDataNonce() []byte {
+	nonce := atomic.AddUint32(&c.dataNonce, 1)
+
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint32(buff, nonce)
+	return buff[4-request.DATA_NONCE_SIZE:]
+}
+
+func (c *Client) nextControlHeader() request.ControlHeader {
+	return request.ControlHeader{
+		ClientID: c.clientID,
+		Counter:  atomic.AddUint64(&c.controlCounter, 1),
+	}
+}
+
+// What we offer the server when opening a session
+func (c *Client) capabilities() request.Capabilities {
+	encryption := uint8(request.ENCRYPTION_NONE)
+	if c.config.Encrypt {
+		encryption = request.ENCRYPTION_CHACHA20POLY1305
+	}
+
+	return request.Capabilities{
+		Encodings:   []uint8{request.ENCODING_BASE32HEX},
+		RecordTypes: records.Types(),
+		MaxDatagram: request.MAX_DATAGRAM_SIZE,
+		FECRatio:    c.config.FECRatio,
+		Encryption:  []uint8{encryption},
+	}
+}
+
+// Makes sure what the server settled on works with how we're set up.
+// Our chunk size depends on whether we're encrypting, so the server has to go along with what we asked for.
+func (c *Client) checkSettled(caps request.Capabilities) error {
+	if !caps.HasRecordType(c.recordType) {
+		return fmt.Errorf("server can't answer with %s records (%s)", dns.TypeToString[c.recordType], caps)
+	}
+
+	if len(caps.Encodings) != 1 || caps.Encodings[0] != request.ENCODING_BASE32HEX {
+		return fmt.Errorf("server settled on query encoding %v, but we only do base32hex", caps.Encodings)
+	}
+
+	if caps.Encrypted() != c.config.Encrypt {
+		return fmt.Errorf("server settled on encryption %v, which isn't what we asked for", caps.Encryption)
+	}
+
+	return nil
+}
+
+func (c *Client) buildResolverPool() (pool *resolverPool, err error) {
+	addrs := c.config.Resolvers
+
+	if c.config.ResolvConf != "" {
+		systemAddrs, err := systemResolvers(c.config.ResolvConf)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read resolvers from %s: %v", c.config.ResolvConf, err)
+		}
+		addrs = append(addrs, systemAddrs...)
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no resolvers configured")
 	}
+
+	var resolvers []resolver
+	for _, addr := range addrs {
+		r, err := parseResolver(addr, c.config)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	return newResolverPool(resolvers), nil
 }
 
 func (c *Client) Run() error {
+	recordType, err := records.ParseRecordType(c.config.RecordType)
+	if err != nil {
+		return err
+	}
+	c.recordType = recordType
+	c.codec, _ = records.GetCodec(recordType)
+
+	c.resolvers, err = c.buildResolverPool()
+	if err != nil {
+		return err
+	}
+
+	c.key = request.DeriveKey(c.config.KeyName, c.config.PSK)
+
 	addr, err := net.ResolveUDPAddr("udp4", c.config.ListenAddr)
 	if err != nil {
 		return err
@@ -41,13 +176,23 @@ func (c *Client) Run() error {
 		return err
 	}
 
-	log.Printf("Listening on %v. Chunk size %d for domain %s\n", c.config.ListenAddr, c.requestSize, c.config.TunnelDomain)
+	log.Printf("Listening on %v. Chunk size %d for domain %s over %s records, via %s, with key %s\n", c.config.ListenAddr, c.requestSize, c.config.TunnelDomain, dns.TypeToString[c.recordType], c.resolvers, c.key.Name)
+
+	// In the background, so a lost probe doesn't hold up the listener.
+	// It's not fatal either, as the server will tell us if our clock is too far out, and we'll sync then.
+	go func() {
+		err := c.syncClock()
+		if err != nil {
+			log.Printf("Couldn't sync our clock with the server's (we'll use our own for now): %v", err)
+		}
+	}()
 
 	table := NATManager{
 		client: c,
 	}
+	go table.janitor()
 
-	buff := make([]byte, 65507)
+	buff := make([]byte, request.MAX_DATAGRAM_SIZE)
 
 	for {
 		n, addr, err := c.conn.ReadFromUDP(buff)
@@ -63,7 +208,10 @@ func (c *Client) Run() error {
 
 		go func() {
 			sess := table.UpsertSession(addr)
-			sess.Write(data)
+			_, err := sess.Write(data)
+			if err != nil {
+				log.Printf("Couldn't send datagram from %v: %v", addr, err)
+			}
 		}()
 	}
 }
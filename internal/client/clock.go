@@ -0,0 +1,52 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// Our clock only needs to be within the server's allowed skew, so anything closer than this isn't worth mentioning
+const clockOffsetWarning = time.Second
+
+// Our idea of the server's time, which control messages are timestamped with
+func (c *Client) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.clockOffset)))
+}
+
+// Asks the server for its time, and works out how far off ours is, assuming the query took as long to get there as to come back
+func (c *Client) syncClock() (err error) {
+	req, err := request.NewTimeProbeRequest(c.key)
+	if err != nil {
+		return
+	}
+
+	var msgBuff bytes.Buffer
+	msgBuff.WriteByte(request.REQ_HEADER_TIME)
+	msgBuff.Write(req.Marshal())
+
+	sent := time.Now()
+	responseBytes, err := c.query(msgBuff.Bytes(), false)
+	if err != nil {
+		return
+	}
+	rtt := time.Since(sent)
+
+	res, err := request.UnmarshalTimeProbeResponse(responseBytes, c.key, req)
+	if err != nil {
+		err = fmt.Errorf("bad time probe response: %v", err)
+		return
+	}
+
+	offset := res.Time().Sub(sent.Add(rtt / 2))
+	atomic.StoreInt64(&c.clockOffset, int64(offset))
+
+	if offset > clockOffsetWarning || offset < -clockOffsetWarning {
+		log.Printf("Our clock is %v off the server's, so we'll use its time instead", offset.Round(time.Millisecond))
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// DNS-over-HTTPS (RFC 8484), using either GET or POST.
+// The HTTP client keeps connections alive (and uses HTTP/2 where it can), so we don't handshake for every query.
+type httpsResolver struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func newHTTPSResolver(u *url.URL, method string, poolSize int) (r *httpsResolver, err error) {
+	method = strings.ToUpper(method)
+	if method != http.MethodGet && method != http.MethodPost {
+		err = fmt.Errorf("unsupported DoH method %s (must be GET or POST)", method)
+		return
+	}
+
+	r = &httpsResolver{
+		url:    u,
+		method: method,
+		client: &http.Client{
+			Timeout: resolverTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: poolSize,
+			},
+		},
+	}
+	return
+}
+
+func (r *httpsResolver) String() string {
+	return r.url.String()
+}
+
+func (r *httpsResolver) exchange(msg *dns.Msg) (response *dns.Msg, err error) {
+	// RFC 8484 asks for an ID of 0, so identical queries are cache-friendly
+	query := msg.Copy()
+	query.Id = 0
+
+	packed, err := query.Pack()
+	if err != nil {
+		return
+	}
+
+	var req *http.Request
+
+	if r.method == http.MethodGet {
+		u := *r.url
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		u.RawQuery = values.Encode()
+
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, r.url.String(), bytes.NewReader(packed))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Accept", dohContentType)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("DoH server responded with %s", res.Status)
+		return
+	}
+
+	response = new(dns.Msg)
+	err = response.Unpack(body)
+	if err != nil {
+		return
+	}
+
+	response.Id = msg.Id
+	return
+}
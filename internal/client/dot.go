@@ -0,0 +1,82 @@
+package client
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// DNS-over-TLS (RFC 7858).
+// TLS handshakes are expensive, so we keep a pool of connections around and reuse them between queries.
+type tlsResolver struct {
+	addr   string
+	client *dns.Client
+	pool   chan *dns.Conn
+}
+
+func newTLSResolver(addr string, poolSize int) *tlsResolver {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	return &tlsResolver{
+		addr: addr,
+		client: &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: resolverTimeout,
+		},
+		pool: make(chan *dns.Conn, poolSize),
+	}
+}
+
+func (r *tlsResolver) String() string {
+	return "tls://" + r.addr
+}
+
+func (r *tlsResolver) getConn() (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn = <-r.pool:
+		reused = true
+	default:
+		conn, err = r.client.Dial(r.addr)
+	}
+	return
+}
+
+func (r *tlsResolver) putConn(conn *dns.Conn) {
+	select {
+	case r.pool <- conn:
+	default:
+		// Pool's full
+		conn.Close()
+	}
+}
+
+func (r *tlsResolver) exchange(msg *dns.Msg) (response *dns.Msg, err error) {
+	conn, reused, err := r.getConn()
+	if err != nil {
+		return
+	}
+
+	response, _, err = r.client.ExchangeWithConn(msg, conn)
+
+	// The resolver may have closed an idle connection on us, so give it one more go on a fresh one
+	if err != nil && reused {
+		log.Printf("Pooled connection to %s failed, redialling: %v", r.addr, err)
+		conn.Close()
+
+		conn, err = r.client.Dial(r.addr)
+		if err != nil {
+			return
+		}
+		response, _, err = r.client.ExchangeWithConn(msg, conn)
+	}
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	r.putConn(conn)
+	return
+}
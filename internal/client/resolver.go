@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How long we give a query before treating it as lost. It has to be well over how long the server may hold a poll
+// (-pollWait, which the server caps at -maxPollWait, 2 seconds by default), plus the round trip.
+// But a query that's never coming back holds up a whole thread until it times out, and the acks it was carrying with it,
+// so it's not much more than that.
+const resolverTimeout = 5 * time.Second
+
+// The longest we let the server hold a poll, leaving room for the round trip under resolverTimeout
+const maxPollWait = resolverTimeout / 2
+
+// A resolver is how we get our queries to the recursive resolver
+type resolver interface {
+	exchange(msg *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// Resolvers are one of:
+//
+//	host[:port], udp://host[:port] or tcp://host[:port] for plain DNS
+//	tls://host[:port] for DNS-over-TLS
+//	https://host[:port]/path for DNS-over-HTTPS
+func parseResolver(s string, config Config) (r resolver, err error) {
+	scheme := "udp"
+	if before, after, found := strings.Cut(s, "://"); found {
+		scheme = before
+		s = after
+	}
+
+	// Every thread has a reader and a writer, and we'd like to keep a connection around for each
+	poolSize := config.Threads * 2
+
+	switch scheme {
+	case "udp", "tcp":
+		r = &plainResolver{
+			net:  scheme,
+			addr: withDefaultPort(s, "53"),
+		}
+
+	case "tls":
+		r = newTLSResolver(withDefaultPort(s, "853"), poolSize)
+
+	case "https":
+		var u *url.URL
+		u, err = url.Parse("https://" + s)
+		if err != nil {
+			return
+		}
+		r, err = newHTTPSResolver(u, config.DoHMethod, poolSize)
+
+	default:
+		err = fmt.Errorf("unsupported resolver scheme %s", scheme)
+	}
+
+	return
+}
+
+func withDefaultPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+// Plain old DNS, over UDP or TCP
+type plainResolver struct {
+	net  string
+	addr string
+}
+
+func (r *plainResolver) String() string {
+	return r.net + "://" + r.addr
+}
+
+func (r *plainResolver) exchange(msg *dns.Msg) (response *dns.Msg, err error) {
+	c := new(dns.Client)
+	c.Net = r.net
+	c.Timeout = resolverTimeout
+
+	response, _, err = c.Exchange(msg, r.addr)
+	if err != nil {
+		return
+	}
+
+	// The answer didn't fit over UDP, so try again over TCP
+	if response.Truncated && c.Net == "udp" {
+		c.Net = "tcp"
+		response, _, err = c.Exchange(msg, r.addr)
+	}
+
+	return
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	resolverBenchTime    = 30 * time.Second
+	resolverMaxErrorRate = 0.5
+	resolverMaxServfails = 3
+	resolverMinSamples   = 5
+	// How much each new sample moves the moving averages
+	resolverEWMAWeight = 0.2
+	// A resolver this many times slower than the pool's median only gets queries when no one faster can take them,
+	// and every resolverSlowProbeInterval picks, so we notice when it speeds up again
+	resolverSlowFactor        = 3
+	resolverSlowProbeInterval = 16
+)
+
+type resolverStats struct {
+	latency        time.Duration
+	errorRate      float64
+	servfails      int // consecutive
+	samples        int
+	latencySamples int // not counting held queries, which don't tell us the latency
+	benchedUntil   time.Time
+}
+
+// A resolverPool stripes queries round-robin across several resolvers, to get around per-resolver rate limits.
+// We keep track of how each resolver is doing, bench the unhealthy ones for a while, and pass over the slow ones.
+type resolverPool struct {
+	resolvers []resolver
+	stats     []resolverStats
+	lock      sync.Mutex
+	next      int
+	picks     int
+}
+
+func newResolverPool(resolvers []resolver) *resolverPool {
+	return &resolverPool{
+		resolvers: resolvers,
+		stats:     make([]resolverStats, len(resolvers)),
+	}
+}
+
+// Reads the system resolvers out of resolv.conf
+func systemResolvers(path string) (addrs []string, err error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return
+	}
+
+	for _, server := range conf.Servers {
+		addrs = append(addrs, net.JoinHostPort(server, conf.Port))
+	}
+	return
+}
+
+func (p *resolverPool) String() string {
+	names := make([]string, len(p.resolvers))
+	for i, r := range p.resolvers {
+		names[i] = r.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// The median latency of the healthy resolvers we've heard enough from, or 0 if there aren't any.
+// With an even number, it's the lower of the middle two, so one slow resolver out of two still stands out.
+func (p *resolverPool) medianLatency(now time.Time) time.Duration {
+	var latencies []time.Duration
+	for _, stats := range p.stats {
+		if stats.latencySamples >= resolverMinSamples && now.After(stats.benchedUntil) {
+			latencies = append(latencies, stats.latency)
+		}
+	}
+
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[(len(latencies)-1)/2]
+}
+
+func (p *resolverPool) slow(i int, median time.Duration) bool {
+	stats := p.stats[i]
+	return median > 0 && stats.latencySamples >= resolverMinSamples && stats.latency > resolverSlowFactor*median
+}
+
+// Picks the next healthy resolver that isn't skip, passing over slow ones if there's a faster one to use.
+// If everyone is benched, we pick whoever is due back first, as it's better than giving up.
+func (p *resolverPool) pick(skip int) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	best := -1
+	fallback := -1
+
+	// Every so often, it's a slow resolver's turn, to keep its latency up to date
+	p.picks++
+	probe := p.picks%resolverSlowProbeInterval == 0
+	median := p.medianLatency(now)
+
+	for n := 0; n < len(p.resolvers); n++ {
+		i := (p.next + n) % len(p.resolvers)
+		if i == skip && len(p.resolvers) > 1 {
+			continue
+		}
+
+		if now.After(p.stats[i].benchedUntil) {
+			if p.slow(i, median) == probe {
+				p.next = i + 1
+				return i
+			}
+
+			if fallback == -1 {
+				fallback = i
+			}
+			continue
+		}
+
+		if best == -1 || p.stats[i].benchedUntil.Before(p.stats[best].benchedUntil) {
+			best = i
+		}
+	}
+
+	if fallback != -1 {
+		p.next = fallback + 1
+		return fallback
+	}
+
+	return best
+}
+
+// A latency of 0 means we don't know it, as the server held the query, so only the error rate is updated
+func (p *resolverPool) record(i int, latency time.Duration, failed bool, servfail bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := &p.stats[i]
+	stats.samples++
+
+	failure := 0.0
+	if failed {
+		failure = 1.0
+	} else if latency > 0 {
+		stats.latency += time.Duration(resolverEWMAWeight * float64(latency-stats.latency))
+		stats.latencySamples++
+	}
+	stats.errorRate += resolverEWMAWeight * (failure - stats.errorRate)
+
+	if servfail {
+		stats.servfails++
+	} else {
+		stats.servfails = 0
+	}
+
+	unhealthy := stats.servfails >= resolverMaxServfails ||
+		(stats.samples >= resolverMinSamples && stats.errorRate > resolverMaxErrorRate)
+
+	if unhealthy && len(p.resolvers) > 1 {
+		log.Printf("Benching resolver %s for %v (error rate %.2f, %d servfails, latency %v)", p.resolvers[i], resolverBenchTime, stats.errorRate, stats.servfails, stats.latency)
+
+		// Give it a clean slate when it comes back
+		*stats = resolverStats{
+			latency:      stats.latency,
+			benchedUntil: time.Now().Add(resolverBenchTime),
+		}
+	}
+}
+
+// If a resolver fails us, we give the query one more go on another.
+// Held queries are ones the server may sit on (long polls), so how long they take says nothing about the resolver.
+func (p *resolverPool) exchange(msg *dns.Msg, held bool) (response *dns.Msg, err error) {
+	skip := -1
+
+	for attempt := 0; attempt < 2 && attempt < len(p.resolvers); attempt++ {
+		i := p.pick(skip)
+
+		start := time.Now()
+		response, err = p.resolvers[i].exchange(msg)
+		servfail := err == nil && response.Rcode == dns.RcodeServerFailure
+
+		latency := time.Since(start)
+		if held {
+			latency = 0
+		}
+		p.record(i, latency, err != nil || servfail, servfail)
+
+		if servfail {
+			err = fmt.Errorf("%s returned SERVFAIL", p.resolvers[i])
+		}
+		if err == nil {
+			return
+		}
+
+		skip = i
+	}
+
+	return
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	minIdleDelay = 50 * time.Millisecond
+	maxIdleDelay = 2 * time.Second
+)
+
+// Decides how many readers should be polling, and how long they rest between empty polls.
+// While data is flowing we ramp up until every reader is polling back to back,
+// and when it dries up we drop back to a single (long) poll with growing gaps, so an idle tunnel costs very few queries.
+type pollScheduler struct {
+	lock      sync.Mutex
+	maxActive int
+	active    int
+	idleDelay time.Duration
+	stopped   bool
+	// Closed (and replaced) whenever readers should take another look
+	wakeChan chan struct{}
+}
+
+func newPollScheduler(maxActive int) *pollScheduler {
+	return &pollScheduler{
+		maxActive: maxActive,
+		active:    1,
+		wakeChan:  make(chan struct{}),
+	}
+}
+
+// Must hold the lock
+func (s *pollScheduler) broadcast() {
+	close(s.wakeChan)
+	s.wakeChan = make(chan struct{})
+}
+
+// Blocks reader until it's one of the active ones, returning false if the scheduler was stopped
+func (s *pollScheduler) wait(reader int) bool {
+	for {
+		s.lock.Lock()
+		if s.stopped {
+			s.lock.Unlock()
+			return false
+		}
+		if reader < s.active {
+			s.lock.Unlock()
+			return true
+		}
+		wake := s.wakeChan
+		s.lock.Unlock()
+
+		<-wake
+	}
+}
+
+// Called when a poll brings back data, so we double how many readers poll
+func (s *pollScheduler) gotData() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.idleDelay = 0
+
+	if s.active < s.maxActive {
+		s.active *= 2
+		if s.active > s.maxActive {
+			s.active = s.maxActive
+		}
+		s.broadcast()
+	}
+}
+
+// Called when a poll comes back empty. Stands a reader down, and returns how long to rest for.
+func (s *pollScheduler) gotNothing() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active > 1 {
+		s.active--
+	}
+
+	if s.idleDelay == 0 {
+		s.idleDelay = minIdleDelay
+	} else {
+		s.idleDelay *= 2
+		if s.idleDelay > maxIdleDelay {
+			s.idleDelay = maxIdleDelay
+		}
+	}
+
+	return s.idleDelay
+}
+
+// Rests for delay, unless something wakes us first
+func (s *pollScheduler) rest(delay time.Duration) {
+	s.lock.Lock()
+	wake := s.wakeChan
+	s.lock.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-wake:
+	}
+}
+
+// Called when we write upstream, as a reply is probably on its way
+func (s *pollScheduler) wake() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.idleDelay != 0 {
+		s.idleDelay = 0
+		s.broadcast()
+	}
+}
+
+// Wakes everyone up for the last time, as the session is done
+func (s *pollScheduler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		s.broadcast()
+	}
+}
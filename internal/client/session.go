@@ -3,39 +3,179 @@ package client
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lachlan2k/dns-tunnel/internal/fec"
 	"github.com/lachlan2k/dns-tunnel/internal/fragmentation"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 	"github.com/miekg/dns"
 )
 
+// If the server forgets our session, we wait this long before trying to reopen it, doubling each time it fails
+const (
+	reopenMinBackoff = time.Second
+	reopenMaxBackoff = 30 * time.Second
+)
+
+// Returned by sendWrite when it had to replace the session, so the write should go again on the new one
+var errRekeyed = errors.New("session ran out of write counters")
+
+// Whether sending again could help, rather than the server saying the same thing until someone fixes its config (or ours).
+// Anything that isn't from the server (like a timeout) is worth another go.
+func retryable(err error) bool {
+	for _, permanent := range []error{request.ErrUnknownKey, request.ErrAuthFailed, request.ErrMalformed, request.ErrUnsupportedVersion, request.ErrIncompatible} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the server got the request and answered, even if the answer was an error
+func answered(err error) bool {
+	var res request.ErrorResponse
+	return err == nil || errors.As(err, &res)
+}
+
+// What the server knows us by. Reopening swaps the whole thing out, so the ID and keys always match,
+// and anything still in flight for an old session can't land in the new one's acks or reassembly.
+type sessionState struct {
+	id  request.SessionID
+	key []byte
+	// Only set if we're encrypting
+	upstream   *request.DataCipher
+	downstream *request.DataCipher
+	// The last write counter we used
+	counter uint32
+	// The largest datagram the server will take
+	maxDatagram int
+
+	readFragTable *fragmentation.FragmentationTable
+	acks          ackTracker
+}
+
+// Hands out the next write counter, or false if they've all been used and the session needs replacing
+func (state *sessionState) nextCounter() (counter uint32, ok bool) {
+	for {
+		last := atomic.LoadUint32(&state.counter)
+		if last == math.MaxUint32 {
+			// It stays used up, rather than wrapping around to counters we've used before
+			return 0, false
+		}
+		if atomic.CompareAndSwapUint32(&state.counter, last, last+1) {
+			return last + 1, true
+		}
+	}
+}
+
 type TunnelClientSession struct {
-	id            request.SessionID
-	client        *Client
-	connAddr      *net.UDPAddr
-	writeFeed     chan *request.WriteRequest
-	fragId        uint16     // TODO: use a pool instead of a counter
-	idLock        sync.Mutex // doing some logic to reset it, so atomic operations aren't enough :()
-	readFragTable fragmentation.FragmentationTable
+	// When a datagram last went either way (unix nanoseconds), so the NAT table can expire us.
+	// It's first, so it's 64-bit aligned for atomics on 32-bit platforms.
+	lastActive int64
+
+	state      atomic.Value // *sessionState, use current()
+	reopenLock sync.Mutex
+	client     *Client
+	connAddr   *net.UDPAddr
+	writeFeed  chan *request.WriteRequest
+	fragId     uint32     // TODO: use a pool instead of a counter
+	idLock     sync.Mutex // doing some logic to reset it, so atomic operations aren't enough :()
+	// How many of our writes fail to get through, to decide how much parity to send
+	upstreamLoss fec.LossEstimator
+	polls        *pollScheduler
+	closed       chan struct{}
+	closeOnce    sync.Once
 }
 
 func newSession(client *Client, conAddr *net.UDPAddr) *TunnelClientSession {
 	return &TunnelClientSession{
-		client:        client,
-		connAddr:      conAddr,
-		writeFeed:     make(chan *request.WriteRequest),
-		fragId:        0,
-		readFragTable: fragmentation.NewFragTable(),
+		client:     client,
+		connAddr:   conAddr,
+		writeFeed:  make(chan *request.WriteRequest),
+		fragId:     0,
+		polls:      newPollScheduler(client.config.Threads),
+		lastActive: time.Now().UnixNano(),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (sess *TunnelClientSession) current() *sessionState {
+	state, _ := sess.state.Load().(*sessionState)
+	if state == nil {
+		return &sessionState{}
+	}
+	return state
+}
+
+// The state is only set once the server has opened the session. It's atomic, so Close can ask from any goroutine.
+func (sess *TunnelClientSession) opened() bool {
+	return sess.state.Load() != nil
+}
+
+func (sess *TunnelClientSession) sessionID() request.SessionID {
+	return sess.current().id
+}
+
+func (sess *TunnelClientSession) touch() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+}
+
+func (sess *TunnelClientSession) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sess.lastActive)))
+}
+
+// Stops our routines, and tells the server to let go of its end. Reason is just for the logs.
+func (sess *TunnelClientSession) Close(reason string) {
+	sess.closeOnce.Do(func() {
+		close(sess.closed)
+		sess.polls.stop()
+
+		if !sess.opened() {
+			log.Printf("Session for %v ended (%s)", sess.connAddr, reason)
+			return
+		}
+
+		state := sess.current()
+		sess.closeOnServer(state)
+
+		log.Printf("Session %d for %v ended (%s), reassembly stats: %+v", state.id, sess.connAddr, reason, state.readFragTable.Stats())
+	})
+}
+
+// Tells the server to let go of a session, logging (rather than returning) any trouble, as it'll time out there anyway
+func (sess *TunnelClientSession) closeOnServer(state *sessionState) {
+	req := request.SessionCloseRequest{
+		ID: state.id,
+	}
+
+	responseBytes, err := sess.sendControlChannelMessage(req.Marshal(state.key), false)
+	if err == nil {
+		_, err = request.UnmarshalSessionCloseResponse(responseBytes)
+	}
+
+	if errors.Is(err, request.ErrUnknownSession) {
+		log.Printf("Server had already forgotten session %d", req.ID)
+	} else if err != nil {
+		log.Printf("Couldn't close session %d on the server (it will time out there instead): %v", req.ID, err)
 	}
 }
 
 func (sess *TunnelClientSession) Write(datagram []byte) (n int, err error) {
+	sess.touch()
+
+	// It's not set until the session's open
+	if max := sess.current().maxDatagram; max > 0 && len(datagram) > max {
+		err = fmt.Errorf("datagram too large for the server (%d > %d bytes)", len(datagram), max)
+		return
+	}
+
 	// Grab a new ID for this packet
 	// TODO: use some sort of "pool" instead of a counter
 	sess.idLock.Lock()
@@ -47,44 +187,47 @@ func (sess *TunnelClientSession) Write(datagram []byte) (n int, err error) {
 	}
 	sess.idLock.Unlock()
 
-	fragmentCount := uint8(math.Ceil(float64(len(datagram)) / float64(sess.client.requestSize)))
+	parityRatio := fec.ParityRatio(sess.client.config.FECRatio, sess.upstreamLoss.Loss())
 
-	// Split the packet into several fragments to be reconstructed
-	for i := uint8(0); i < fragmentCount; i++ {
-		header := fragmentation.FragmentationHeader{
-			Index:           i,
-			ID:              id,
-			IsFinalFragment: (i + 1) == fragmentCount,
-		}
-
-		start := sess.client.requestSize * int(i)
-		end := sess.client.requestSize * int(i+1)
-
-		if end > len(datagram) {
-			end = len(datagram)
-		}
+	fragments, err := fragmentation.Split(datagram, id, sess.client.requestSize, parityRatio)
+	if err != nil {
+		return
+	}
 
-		chunk := datagram[start:end]
+	// Whatever we're talking to will probably answer, so stop resting
+	sess.polls.wake()
 
+	// Send the packet as several fragments to be reconstructed
+	for _, fragment := range fragments {
 		req := &request.WriteRequest{
-			ID:                  sess.id,
-			Data:                chunk,
-			FragmentationHeader: header,
+			Data:                fragment.Data,
+			FragmentationHeader: fragment.Header,
 		}
 
-		sess.writeFeed <- req
+		select {
+		case sess.writeFeed <- req:
+		case <-sess.closed:
+			err = errors.New("session closed")
+			return
+		}
 	}
 
 	return len(datagram), nil
 }
 
-func (sess *TunnelClientSession) injestPollResponse(response request.PollResponse) (status uint8, err error) {
+// State is the session the response came back for, which may have been replaced since
+func (sess *TunnelClientSession) injestPollResponse(state *sessionState, response request.PollResponse) (status uint8, err error) {
 	status = response.Status
 
 	switch status {
 	case request.POLL_OK:
+		if !state.acks.receive(response.Seq) {
+			// We've already got this one, the server must have resent it before our ack got through
+			return
+		}
+
 		var completePacket []byte
-		completePacket, err = sess.readFragTable.FeedFragment(response.FragmentationHeader, response.Data)
+		completePacket, err = state.readFragTable.FeedFragment(response.FragmentationHeader, response.Data)
 
 		if err != nil {
 			log.Printf("Error feeding fragment (continuing): %v", err)
@@ -92,6 +235,7 @@ func (sess *TunnelClientSession) injestPollResponse(response request.PollRespons
 		}
 
 		if completePacket != nil {
+			sess.touch()
 			_, err = sess.client.conn.WriteToUDP(completePacket, sess.connAddr)
 			if err != nil {
 				// todo: die
@@ -99,69 +243,172 @@ func (sess *TunnelClientSession) injestPollResponse(response request.PollRespons
 			}
 		}
 
-	case request.POLL_ERROR:
-		log.Printf("Got a poll error: %v", response)
+	case request.POLL_SKIP:
+		// The server has given up on sending this one, as we could do without it
+		state.acks.receive(response.Seq)
 	}
 
 	return
 }
 
-func (sess *TunnelClientSession) writeRoutine() {
+// Opens a new session to replace staleID, which the server has forgotten (most likely, it restarted).
+// Every routine that notices waits on the one reopen, and the local flow carries on with the new ID.
+func (sess *TunnelClientSession) reopen(staleID request.SessionID) {
+	sess.replace(staleID, "server doesn't know it any more")
+}
+
+// Replaces stale with a new session (and new keys), once it's used up its write counters
+func (sess *TunnelClientSession) rekey(stale *sessionState) {
+	if sess.replace(stale.id, "ran out of write counters") {
+		// The server would let it go eventually, but there's no point waiting
+		sess.closeOnServer(stale)
+	}
+}
+
+// Does the work for reopen and rekey, returning whether we were the ones to replace it
+func (sess *TunnelClientSession) replace(staleID request.SessionID, reason string) bool {
+	sess.reopenLock.Lock()
+	defer sess.reopenLock.Unlock()
+
+	if sess.sessionID() != staleID {
+		// Someone else already reopened it
+		return false
+	}
+
+	log.Printf("Reopening session %d (%s)", staleID, reason)
+
+	backoff := reopenMinBackoff
 	for {
-		req := <-sess.writeFeed
+		err := sess.initialise()
+		if err == nil {
+			return true
+		}
 
-		encodedResponse, err := sess.sendDataMessage(req.Marshal())
+		if !retryable(err) {
+			// It'll take someone changing the server's config (or ours), so there's no point trying again soon
+			backoff = reopenMaxBackoff
+		}
 
-		if err != nil {
-			log.Printf("Error sending write request: %v", err)
-			continue
+		log.Printf("Couldn't reopen session %d (trying again in %v): %v", staleID, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-sess.closed:
+			return false
 		}
 
-		responseBytes, err := request.DecodeResponse(encodedResponse)
+		backoff *= 2
+		if backoff > reopenMaxBackoff {
+			backoff = reopenMaxBackoff
+		}
+	}
+}
 
-		if err != nil {
-			log.Printf("Couldn't decode response %s: %v", encodedResponse, err)
-			continue
+func (sess *TunnelClientSession) writeRoutine() {
+	for {
+		var req *request.WriteRequest
+		select {
+		case req = <-sess.writeFeed:
+		case <-sess.closed:
+			return
 		}
 
-		response, err := request.UnmarshalPollResponse(responseBytes)
+		// If the server had forgotten us (or we ran out of counters), the fragment still deserves a go on the new session
+		for attempt := 0; attempt < 2; attempt++ {
+			err := sess.sendWrite(req)
+			if errors.Is(err, errRekeyed) || errors.Is(err, request.ErrUnknownSession) {
+				continue
+			}
 
-		if err != nil {
-			log.Printf("Couldn't unmarshal write response %s: %v", responseBytes, err)
-			continue
+			if err != nil {
+				log.Printf("Error sending write request: %v", err)
+			}
+			break
 		}
+	}
+}
+
+// Reopens the session if the server has forgotten it, so it's worth sending again
+func (sess *TunnelClientSession) sendWrite(req *request.WriteRequest) (err error) {
+	state := sess.current()
+	req.ID = state.id
+	req.Ack = state.acks.ack()
 
-		sess.injestPollResponse(response)
+	var ok bool
+	req.Counter, ok = state.nextCounter()
+	if !ok {
+		// The server would take a reused counter for a replay (and for encrypted sessions, it would give the key away),
+		// so start over with a new session
+		sess.rekey(state)
+		return errRekeyed
 	}
+
+	responseBytes, err := sess.sendDataMessage(req.Marshal(state.key, state.upstream))
+	// Error responses still got through, so they don't count as loss
+	sess.upstreamLoss.Record(!answered(err))
+
+	if errors.Is(err, request.ErrUnknownSession) {
+		sess.reopen(state.id)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	response, err := request.UnmarshalPollResponse(responseBytes, state.downstream)
+	if err != nil {
+		return fmt.Errorf("couldn't unmarshal write response %s: %v", responseBytes, err)
+	}
+
+	sess.injestPollResponse(state, response)
+	return nil
 }
 
-func (sess *TunnelClientSession) readRoutine() {
+func (sess *TunnelClientSession) readRoutine(reader int) {
 	sleep := func() {
 		time.Sleep(200 * time.Millisecond)
 	}
 
+	wait := sess.client.config.PollWait
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	waitMS := wait.Milliseconds()
+
 	for {
+		if !sess.polls.wait(reader) {
+			return
+		}
+
+		state := sess.current()
 		req := request.PollRequest{
-			ID: sess.id,
+			ID:     state.id,
+			Ack:    state.acks.ack(),
+			WaitMS: uint16(waitMS),
 		}
 
-		encodedResponse, err := sess.sendControlChannelMessage(req.Marshal())
+		responseBytes, err := sess.sendControlChannelMessage(req.Marshal(state.key), true)
 
-		if err != nil {
-			log.Printf("Error sending data to control channel: %v", err)
-			sleep()
+		if errors.Is(err, request.ErrUnknownSession) {
+			sess.reopen(state.id)
 			continue
 		}
 
-		responseBytes, err := request.DecodeResponse(encodedResponse)
-
 		if err != nil {
-			log.Printf("Couldn't decode response %s: %v", encodedResponse, err)
-			sleep()
+			log.Printf("Error sending data to control channel: %v", err)
+			if retryable(err) {
+				sleep()
+			} else {
+				// Polling again soon would just get the same answer
+				select {
+				case <-time.After(reopenMaxBackoff):
+				case <-sess.closed:
+				}
+			}
 			continue
 		}
 
-		response, err := request.UnmarshalPollResponse(responseBytes)
+		response, err := request.UnmarshalPollResponse(responseBytes, state.downstream)
 
 		if err != nil {
 			log.Printf("Couldn't unmarshal poll resonse %s: %v", responseBytes, err)
@@ -169,7 +416,7 @@ func (sess *TunnelClientSession) readRoutine() {
 			continue
 		}
 
-		status, err := sess.injestPollResponse(response)
+		status, err := sess.injestPollResponse(state, response)
 
 		if err != nil {
 			log.Printf("Error injesting poll response: %v", err)
@@ -178,40 +425,32 @@ func (sess *TunnelClientSession) readRoutine() {
 		}
 
 		if status == request.POLL_NO_DATA {
-			sleep()
+			sess.polls.rest(sess.polls.gotNothing())
+		} else {
+			sess.polls.gotData()
 		}
 	}
 }
 
-func (sess *TunnelClientSession) sendMessage(msg []byte, controlChannel bool) (response string, err error) {
-	var msgBuff bytes.Buffer
-
-	if controlChannel {
-		msgBuff.WriteByte(request.REQ_HEADER_CTRL)
-		encryptedMsg, err := request.EncryptMessage(msg, sess.client.config.PSK)
-		if err != nil {
-			return "", err
-		}
-		msgBuff.Write(encryptedMsg)
-	} else {
-		msgBuff.WriteByte(request.REQ_HEADER_DATA)
-		msgBuff.Write(msg)
-	}
-
-	encodedMsg := request.EncodeRequest(msgBuff.Bytes())
+// Sends a message to the server as a DNS query, and decodes what it answers with.
+// Held is for polls, which the server may sit on, so they don't count towards the resolver's latency.
+func (c *Client) query(msg []byte, held bool) (response []byte, err error) {
+	encodedMsg := request.EncodeRequest(msg)
 
-	fqdn := dns.Fqdn(encodedMsg + "." + sess.client.config.TunnelDomain)
+	fqdn := dns.Fqdn(encodedMsg + "." + c.config.TunnelDomain)
 
 	dnsMsg := new(dns.Msg)
-	dnsMsg.SetQuestion(fqdn, dns.TypeTXT)
+	dnsMsg.SetQuestion(fqdn, c.recordType)
 
-	c := new(dns.Client)
-	c.Timeout = 60 * time.Second
+	// Advertising a bigger UDP size lets the server pack more data into each response
+	if c.config.EDNSSize > dns.MinMsgSize {
+		dnsMsg.SetEdns0(c.config.EDNSSize, false)
+	}
 
-	responseMsg, _, err := c.Exchange(dnsMsg, sess.client.config.Resolver)
+	responseMsg, err := c.resolvers.exchange(dnsMsg, held)
 
 	if err != nil {
-		err = fmt.Errorf("error making dns request (%v) for %s (session %d): %v", err, fqdn, sess.id, responseMsg)
+		err = fmt.Errorf("error making dns request (%v) for %s: %v", err, fqdn, responseMsg)
 		return
 	}
 
@@ -220,66 +459,169 @@ func (sess *TunnelClientSession) sendMessage(msg []byte, controlChannel bool) (r
 		return
 	}
 
-	// todo: multiple answers?
-	txtResponse, ok := responseMsg.Answer[0].(*dns.TXT)
-
-	if !ok {
-		err = fmt.Errorf("couldn't turn response (%v) into a txt response", responseMsg.Answer[0])
+	response, err = c.codec.Decode(c.config.TunnelDomain, responseMsg.Answer)
+	if err != nil {
+		err = fmt.Errorf("couldn't decode response (%v): %v", responseMsg.Answer, err)
 		return
 	}
 
-	if len(txtResponse.Txt) == 0 {
-		err = fmt.Errorf("empty txt response")
-		return
+	// Whatever we asked, the server might have answered with an error instead
+	return request.UnmarshalResponse(response)
+}
+
+func (sess *TunnelClientSession) sendMessage(msg []byte, controlChannel bool, held bool) (response []byte, err error) {
+	var msgBuff bytes.Buffer
+
+	if controlChannel {
+		msgBuff.WriteByte(request.REQ_HEADER_CTRL)
+		encryptedMsg, err := request.EncryptMessage(msg, sess.client.key, sess.client.nextControlHeader())
+		if err != nil {
+			return nil, err
+		}
+		msgBuff.Write(encryptedMsg)
+	} else {
+		msgBuff.WriteByte(request.REQ_HEADER_DATA)
+		msgBuff.Write(sess.client.nextDataNonce())
+		msgBuff.Write(msg)
 	}
 
-	response = txtResponse.Txt[0]
+	response, err = sess.client.query(msgBuff.Bytes(), held)
+	if !answered(err) {
+		// Error responses carry their own detail
+		err = fmt.Errorf("%w (session %d)", err, sess.sessionID())
+	}
 	return
 }
 
-func (sess *TunnelClientSession) sendControlChannelMessage(msg []byte) (response string, err error) {
-	dataToSend := make([]byte, 8+len(msg))
-	timestamp := time.Now().UnixMilli()
-	binary.BigEndian.PutUint64(dataToSend[0:8], uint64(timestamp))
-	copy(dataToSend[8:], msg)
+// Timestamps the message with our idea of the server's time. If the server still thinks we're too far out,
+// we sync with it and try again once (which also catches our clock jumping, or the server's).
+// Replays get another go too, as that's just a new counter away.
+func (sess *TunnelClientSession) sendControlChannelMessage(msg []byte, held bool) (response []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		dataToSend := make([]byte, 8+len(msg))
+		timestamp := sess.client.now().UnixMilli()
+		binary.BigEndian.PutUint64(dataToSend[0:8], uint64(timestamp))
+		copy(dataToSend[8:], msg)
+
+		response, err = sess.sendMessage(dataToSend, true, held)
+		if attempt > 0 {
+			return
+		}
 
-	return sess.sendMessage(dataToSend, true)
+		switch {
+		case errors.Is(err, request.ErrClockSkew):
+			log.Printf("Server says our clock is too far from its own, syncing with it")
+			if syncErr := sess.client.syncClock(); syncErr != nil {
+				err = fmt.Errorf("%w, and we couldn't sync with the server: %v", err, syncErr)
+				return
+			}
+		case errors.Is(err, request.ErrReplay):
+			// Sending it again gives it a new counter, which is all it needs
+		default:
+			return
+		}
+	}
 }
 
-func (sess *TunnelClientSession) sendDataMessage(msg []byte) (response string, err error) {
-	return sess.sendMessage(msg, false)
+func (sess *TunnelClientSession) sendDataMessage(msg []byte) (response []byte, err error) {
+	return sess.sendMessage(msg, false, false)
 }
 
 func (sess *TunnelClientSession) initialise() (err error) {
 	req := request.SessionOpenRequest{
-		DestAddr: sess.client.config.DialAddr,
+		Capabilities: sess.client.capabilities(),
+		DestAddr:     sess.client.config.DialAddr,
 	}
 
-	encodedResponse, err := sess.sendControlChannelMessage(req.Marshal())
+	var response request.SessionOpenResponse
+	var secret []byte
+	if sess.client.config.PSKOnly {
+		response, secret, err = sess.openWithPSK(req)
+	} else {
+		response, secret, err = sess.openWithHandshake(req)
+	}
 	if err != nil {
 		return
 	}
 
-	responseBytes, err := request.DecodeResponse(encodedResponse)
+	switch response.Status {
+	case request.SESSION_OPEN_OK:
+	case request.SESSION_OPEN_DENIED:
+		err = fmt.Errorf("server denied the session to %s (its ACL doesn't allow key %s to dial there)", req.DestAddr, sess.client.key.Name)
+		return
+	default:
+		err = fmt.Errorf("session open failed, response: %v", response)
+		return
+	}
+
+	caps := response.Capabilities
+	err = sess.client.checkSettled(caps)
 	if err != nil {
+		// The server's holding it open for us, but we can't use it
+		sess.closeOnServer(&sessionState{
+			id:  response.ID,
+			key: request.DeriveSessionKey(secret, response.ID),
+		})
 		return
 	}
 
-	response, err := request.UnmarshalSessionOpenResponse(responseBytes)
+	// A new session's sequence numbers and packet IDs start over, so it gets its own acks and reassembly
+	state := &sessionState{
+		id:            response.ID,
+		key:           request.DeriveSessionKey(secret, response.ID),
+		maxDatagram:   caps.MaxDatagram,
+		readFragTable: fragmentation.NewFragTable(fragmentation.DefaultLimits),
+	}
+	if caps.Encrypted() {
+		state.upstream, state.downstream = request.NewDataCiphers(secret, response.ID)
+	}
+	sess.state.Store(state)
+	log.Printf("Session initialized with ID %d (%s)", response.ID, caps)
+
+	return
+}
+
+// The old way of opening a session, where we make the secret and send it under the PSK
+func (sess *TunnelClientSession) openWithPSK(req request.SessionOpenRequest) (response request.SessionOpenResponse, secret []byte, err error) {
+	secret, err = request.NewSessionSecret()
+	if err != nil {
+		return
+	}
+	req.Secret = secret
+
+	responseBytes, err := sess.sendControlChannelMessage(req.Marshal(), false)
+	if err != nil {
+		return
+	}
+
+	response, err = request.UnmarshalSessionOpenResponse(responseBytes)
 	if err != nil {
 		err = fmt.Errorf("couldn't unmarshal sesion open response: %v", err)
+	}
+	return
+}
+
+// Opens the session with a handshake, so the secret is never sent, and the server has to prove it knows the PSK
+func (sess *TunnelClientSession) openWithHandshake(req request.SessionOpenRequest) (response request.SessionOpenResponse, secret []byte, err error) {
+	hs := request.NewHandshake(sess.client.key, true)
+
+	msg, err := req.MarshalHandshake(hs)
+	if err != nil {
 		return
 	}
 
-	if response.Status != request.SESSION_OPEN_OK {
-		err = fmt.Errorf("session open failed, response: %v", response)
+	responseBytes, err := sess.sendControlChannelMessage(msg, false)
+	if err != nil {
 		return
 	}
 
-	sess.id = response.ID
-	log.Printf("Session initialized with ID %d", sess.id)
+	response, err = request.UnmarshalSessionHandshakeResponse(responseBytes, hs)
+	if err != nil {
+		err = fmt.Errorf("couldn't complete session handshake: %v", err)
+		return
+	}
 
-	return
+	return response, hs.Secret(), nil
 }
 
 func (sess *TunnelClientSession) Open() (err error) {
@@ -290,7 +632,7 @@ func (sess *TunnelClientSession) Open() (err error) {
 
 	for i := 0; i < sess.client.config.Threads; i++ {
 		go sess.writeRoutine()
-		go sess.readRoutine()
+		go sess.readRoutine(i)
 	}
 
 	return
@@ -1,14 +1,18 @@
 package client
 
 import (
+	"fmt"
+	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+// How often the janitor looks for sessions that have gone quiet
+const natJanitorInterval = 30 * time.Second
+
 type TableEntry struct {
-	sess     *TunnelClientSession
-	lastTime time.Time
+	sess *TunnelClientSession
 }
 
 type NATManager struct {
@@ -16,8 +20,24 @@ type NATManager struct {
 	client *Client
 }
 
+// Closes sessions that haven't sent or received a datagram in a while, here and on the server
 func (mgr *NATManager) janitor() {
-	// todo: clean up expired sessions
+	for {
+		time.Sleep(natJanitorInterval)
+
+		mgr.table.Range(func(key, value any) bool {
+			sess := value.(*TableEntry).sess
+
+			if idle := sess.idleTime(); idle > mgr.client.config.NATTimeout {
+				mgr.table.Delete(key)
+				go sess.Close(fmt.Sprintf("idle for %v", idle.Round(time.Second)))
+			} else if table := sess.current().readFragTable; table != nil {
+				// It's not there until the session's open
+				table.Expire()
+			}
+			return true
+		})
+	}
 }
 
 func (mgr *NATManager) UpsertSession(addr *net.UDPAddr) (sess *TunnelClientSession) {
@@ -25,14 +45,22 @@ func (mgr *NATManager) UpsertSession(addr *net.UDPAddr) (sess *TunnelClientSessi
 	entry, ok := mgr.table.Load(key)
 
 	if !ok {
-		sess := newSession(mgr.client, addr)
-		mgr.table.Store(key, &TableEntry{
-			sess:     sess,
-			lastTime: time.Now(),
+		// Datagrams arrive in their own goroutines, so make sure only one of them opens the session
+		entry, ok = mgr.table.LoadOrStore(key, &TableEntry{
+			sess: newSession(mgr.client, addr),
 		})
-		sess.Open()
-		return sess
-	} else {
-		return entry.(*TableEntry).sess
+		if !ok {
+			sess = entry.(*TableEntry).sess
+			err := sess.Open()
+			if err != nil {
+				log.Printf("Couldn't open session for %v: %v", addr, err)
+				// The next datagram can have another go
+				mgr.table.Delete(key)
+				sess.Close("couldn't open")
+			}
+			return
+		}
 	}
+
+	return entry.(*TableEntry).sess
 }
@@ -0,0 +1,211 @@
+package fec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Systematic Reed-Solomon erasure coding over GF(2^8).
+// Data shards are sent as-is, and parity shard i is row i of a Cauchy matrix applied to the data shards.
+// Every square submatrix of [I; Cauchy] is invertible, so any k of the n shards are enough to rebuild the data.
+
+// Shards are indexed by a byte, so data and parity together can't go past this
+const MAX_SHARDS = 256
+
+var expTable [512]byte
+var logTable [256]byte
+
+func init() {
+	// Generator 2, with the usual 0x11d polynomial
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(expTable); i++ {
+		expTable[i] = expTable[i-255]
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// Coefficient of data shard j in parity shard i
+func cauchy(dataCount int, i int, j int) byte {
+	// x = dataCount+i and y = j never overlap, so x^y is never zero
+	return inv(byte(dataCount+i) ^ byte(j))
+}
+
+// The row of the encoding matrix that produces shard index
+func matrixRow(dataCount int, index int) []byte {
+	row := make([]byte, dataCount)
+	if index < dataCount {
+		row[index] = 1
+		return row
+	}
+	for j := range row {
+		row[j] = cauchy(dataCount, index-dataCount, j)
+	}
+	return row
+}
+
+// dst += c * src
+func mulAdd(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
+
+func checkShardCounts(dataCount int, parityCount int) error {
+	if dataCount < 1 || parityCount < 0 || dataCount+parityCount > MAX_SHARDS {
+		return fmt.Errorf("can't have %d data and %d parity shards (max %d total)", dataCount, parityCount, MAX_SHARDS)
+	}
+	return nil
+}
+
+// Encode makes parityCount parity shards for data, which must all be the same length
+func Encode(data [][]byte, parityCount int) (parity [][]byte, err error) {
+	err = checkShardCounts(len(data), parityCount)
+	if err != nil {
+		return
+	}
+
+	shardSize := len(data[0])
+	for _, shard := range data {
+		if len(shard) != shardSize {
+			err = errors.New("data shards must all be the same length")
+			return
+		}
+	}
+
+	parity = make([][]byte, parityCount)
+	for i := range parity {
+		parity[i] = make([]byte, shardSize)
+		for j, shard := range data {
+			mulAdd(parity[i], cauchy(len(data), i, j), shard)
+		}
+	}
+
+	return
+}
+
+// Reconstruct fills in the missing (nil) data shards, out of at least dataCount shards that are present.
+// Shards are indexed with the data first, then the parity.
+func Reconstruct(shards [][]byte, dataCount int) error {
+	err := checkShardCounts(dataCount, len(shards)-dataCount)
+	if err != nil {
+		return err
+	}
+
+	// Take the first dataCount shards we've got
+	var present []int
+	shardSize := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardSize == -1 {
+			shardSize = len(shard)
+		} else if len(shard) != shardSize {
+			return errors.New("shards must all be the same length")
+		}
+		if len(present) < dataCount {
+			present = append(present, i)
+		}
+	}
+
+	if len(present) < dataCount {
+		return fmt.Errorf("need %d shards to reconstruct, only have %d", dataCount, len(present))
+	}
+
+	var missing []int
+	for i := 0; i < dataCount; i++ {
+		if shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// The rows of the encoding matrix that made the shards we have, which we invert to get back to the data
+	matrix := make([][]byte, dataCount)
+	for r, index := range present {
+		matrix[r] = matrixRow(dataCount, index)
+	}
+
+	inverse, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range missing {
+		shard := make([]byte, shardSize)
+		for r, index := range present {
+			mulAdd(shard, inverse[i][r], shards[index])
+		}
+		shards[i] = shard
+	}
+
+	return nil
+}
+
+// Gauss-Jordan elimination, which leaves matrix in a mess
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := inv(matrix[col][col])
+		for j := 0; j < n; j++ {
+			matrix[col][j] = mul(matrix[col][j], scale)
+			inverse[col][j] = mul(inverse[col][j], scale)
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			factor := matrix[row][col]
+			mulAdd(matrix[row], factor, matrix[col])
+			mulAdd(inverse[row], factor, inverse[col])
+		}
+	}
+
+	return inverse, nil
+}
@@ -0,0 +1,56 @@
+package fec
+
+import "sync"
+
+const (
+	// Never send more parity than data
+	MAX_PARITY_RATIO = 1.0
+	// How much each new sample moves the loss estimate
+	lossEWMAWeight = 0.05
+)
+
+// Keeps a moving average of how many of our fragments go missing, so we can send more parity over worse paths
+type LossEstimator struct {
+	lock sync.Mutex
+	loss float64
+}
+
+func (e *LossEstimator) Record(lost bool) {
+	sample := 0.0
+	if lost {
+		sample = 1.0
+	}
+
+	e.lock.Lock()
+	e.loss += lossEWMAWeight * (sample - e.loss)
+	e.lock.Unlock()
+}
+
+func (e *LossEstimator) Loss() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.loss
+}
+
+// How many parity fragments to send per data fragment.
+// A base of 0 leaves FEC off, otherwise we send at least base, or enough to cover twice the measured loss.
+func ParityRatio(base float64, loss float64) float64 {
+	if base <= 0 {
+		return 0
+	}
+
+	ratio := base
+	if loss < 1 {
+		// Out of k data and m parity fragments, we can lose m/(k+m) of them
+		if needed := 2 * loss / (1 - loss); needed > ratio {
+			ratio = needed
+		}
+	} else {
+		ratio = MAX_PARITY_RATIO
+	}
+
+	if ratio > MAX_PARITY_RATIO {
+		ratio = MAX_PARITY_RATIO
+	}
+	return ratio
+}
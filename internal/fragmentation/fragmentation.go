@@ -2,52 +2,279 @@ package fragmentation
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
-	"reflect"
+	"math"
 	"sync"
+	"time"
 
+	"github.com/lachlan2k/dns-tunnel/internal/fec"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 )
 
 type FragmentationHeader = request.FragmentationHeader
 
-type PacketFragment struct {
-	data []byte
-	seen bool
+// Limits on how long and how much we'll buffer while reassembling packets
+type Limits struct {
+	// How long a packet can go without receiving a fragment before we give up on it
+	Timeout time.Duration
+	// How many bytes we'll buffer before evicting the least recently touched packets
+	MaxBufferedBytes int
+}
+
+var DefaultLimits = Limits{
+	Timeout:          30 * time.Second,
+	MaxBufferedBytes: 1 << 20,
+}
+
+// Rough bookkeeping cost of a fragment on top of its data, so floods of empty fragments still count
+const fragmentCost = 64
+
+// Counters for what happened to the packets going through a table
+type Stats struct {
+	Completed  uint64 // reassembled and handed back
+	Expired    uint64 // incomplete packets that timed out
+	Evicted    uint64 // incomplete packets pushed out to stay under MaxBufferedBytes
+	Dropped    uint64 // packets thrown away for being invalid (too large, conflicting fragments)
+	Duplicates uint64 // fragments we'd already seen, or arrived after their packet was done
+}
+
+// FEC packets are prefixed with the datagram's length, so we know how much padding to drop
+const fecLengthSize = 2
+
+// Senders never send more parity than data, nor more shards than the code can handle
+func fecShardCount(dataCount int) int {
+	if 2*dataCount > fec.MAX_SHARDS {
+		return fec.MAX_SHARDS
+	}
+	return 2 * dataCount
+}
+
+// How many finished packet IDs we remember, so stragglers don't start a packet that will never finish
+const maxFinished = 4096
+
+type finishedPacket struct {
+	id       uint32
+	deadline time.Time
 }
 
 type Packet struct {
-	fragments     []PacketFragment
-	receivedCount uint8
-	expectedCount uint8
+	id            uint32
+	fragments     map[uint16][]byte
+	expectedCount int // 0 until we've seen the final fragment (or, for FEC packets, how many fragments it takes)
+	dataCount     int // 0 unless this is an FEC packet
+	shardSize     int
+	size          int
+	cost          int // size, plus bookkeeping
+	deadline      time.Time
+	element       *list.Element
+}
+
+// Packets live in a map (so idle tables are small), and in a list ordered by when they last received a fragment.
+// As every fragment pushes a packet's deadline back, the back of the list is always the first to expire, and the first to evict.
+type FragmentationTable struct {
+	packets  map[uint32]*Packet
+	lru      *list.List
+	buffered int
+	// Packets we've handed back recently, oldest at the back
+	finished      map[uint32]*list.Element
+	finishedOrder *list.List
+	limits        Limits
+	stats         Stats
 	lock          sync.Mutex
 }
 
-func (p *Packet) reset() {
-	p.receivedCount = 0
-	p.expectedCount = 0
-	for i := range p.fragments {
-		p.fragments[i] = PacketFragment{
-			data: nil,
-			seen: false,
+func NewFragTable(limits Limits) *FragmentationTable {
+	return &FragmentationTable{
+		packets:       make(map[uint32]*Packet),
+		lru:           list.New(),
+		finished:      make(map[uint32]*list.Element),
+		finishedOrder: list.New(),
+		limits:        limits,
+	}
+}
+
+func (t *FragmentationTable) Stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stats
+}
+
+func (t *FragmentationTable) removePacket(packet *Packet) {
+	delete(t.packets, packet.id)
+	t.lru.Remove(packet.element)
+	t.buffered -= packet.cost
+}
+
+func (t *FragmentationTable) describe(packet *Packet) string {
+	expected := "?"
+	if packet.expectedCount != 0 {
+		expected = fmt.Sprint(packet.expectedCount)
+	}
+	return fmt.Sprintf("packet %d (%d/%s fragments)", packet.id, len(packet.fragments), expected)
+}
+
+// Removes a packet we're done with, and remembers its ID for a while. Must hold the lock.
+func (t *FragmentationTable) finish(packet *Packet) {
+	t.removePacket(packet)
+
+	if t.finishedOrder.Len() >= maxFinished {
+		oldest := t.finishedOrder.Remove(t.finishedOrder.Back()).(finishedPacket)
+		delete(t.finished, oldest.id)
+	}
+
+	t.finished[packet.id] = t.finishedOrder.PushFront(finishedPacket{
+		id:       packet.id,
+		deadline: time.Now().Add(t.limits.Timeout),
+	})
+}
+
+// Throws out packets that have passed their deadline. Must hold the lock.
+func (t *FragmentationTable) expire(now time.Time) {
+	for t.finishedOrder.Len() > 0 {
+		oldest := t.finishedOrder.Back().Value.(finishedPacket)
+		if now.Before(oldest.deadline) {
+			break
 		}
+		t.finishedOrder.Remove(t.finishedOrder.Back())
+		delete(t.finished, oldest.id)
+	}
+
+	for t.lru.Len() > 0 {
+		packet := t.lru.Back().Value.(*Packet)
+		if now.Before(packet.deadline) {
+			return
+		}
+
+		log.Printf("Reassembly of %s timed out", t.describe(packet))
+		t.removePacket(packet)
+		t.stats.Expired++
 	}
 }
 
-type FragmentationTable struct {
-	packets []Packet
+// Throws out the least recently touched packets (other than keep) until we're under the limit. Must hold the lock.
+func (t *FragmentationTable) evict(keep *Packet) {
+	for t.buffered > t.limits.MaxBufferedBytes && t.lru.Len() > 1 {
+		packet := t.lru.Back().Value.(*Packet)
+		if packet == keep {
+			return
+		}
+
+		log.Printf("Evicting %s, as %d bytes are buffered", t.describe(packet), t.buffered)
+		t.removePacket(packet)
+		t.stats.Evicted++
+	}
+}
+
+// Expires old packets without feeding a new fragment, for tables that have gone quiet
+func (t *FragmentationTable) Expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expire(time.Now())
+}
+
+type Fragment struct {
+	Header FragmentationHeader
+	Data   []byte
+}
+
+// Splits a datagram into fragments of at most chunkSize bytes, so long as fragmentation headers can describe them all.
+// With a parityRatio above 0, we add that many parity fragments per data fragment (rounding up),
+// so the datagram can be rebuilt from any DataCount of them.
+func Split(datagram []byte, id uint32, chunkSize int, parityRatio float64) (fragments []Fragment, err error) {
+	if len(datagram) > request.MAX_DATAGRAM_SIZE {
+		err = fmt.Errorf("datagram too large (%d > %d bytes)", len(datagram), request.MAX_DATAGRAM_SIZE)
+		return
+	}
+
+	if chunkSize < 1 {
+		err = fmt.Errorf("chunk size (%d) too small to fragment into", chunkSize)
+		return
+	}
+
+	if parityRatio > 0 {
+		fragments, err = splitFEC(datagram, id, chunkSize, parityRatio)
+		if fragments != nil || err != nil {
+			return
+		}
+	}
+
+	// Empty datagrams are still datagrams, and get a single empty fragment
+	count := (len(datagram) + chunkSize - 1) / chunkSize
+	if count == 0 {
+		count = 1
+	}
+
+	if count > request.MAX_FRAG_INDEX+1 {
+		err = fmt.Errorf("datagram of %d bytes needs %d fragments of %d bytes, but we can only have %d", len(datagram), count, chunkSize, request.MAX_FRAG_INDEX+1)
+		return
+	}
+
+	fragments = make([]Fragment, count)
+	for i := range fragments {
+		start := chunkSize * i
+		end := start + chunkSize
+		if end > len(datagram) {
+			end = len(datagram)
+		}
+
+		fragments[i] = Fragment{
+			Header: FragmentationHeader{
+				ID:              id,
+				Index:           uint16(i),
+				IsFinalFragment: i == count-1,
+			},
+			Data: datagram[start:end],
+		}
+	}
+
+	return
 }
 
-func NewFragTable() FragmentationTable {
-	packets := make([]Packet, request.MAX_FRAG_ID+1)
-	for i := range packets {
-		packets[i].fragments = make([]PacketFragment, request.MAX_FRAG_INDEX)
+// Returns nil fragments if the datagram needs too many to code, in which case it goes without parity
+func splitFEC(datagram []byte, id uint32, chunkSize int, parityRatio float64) (fragments []Fragment, err error) {
+	// The datagram gets a length prefix, then padded out so every shard is the same size
+	payloadSize := fecLengthSize + len(datagram)
+	dataCount := (payloadSize + chunkSize - 1) / chunkSize
+
+	parityCount := int(math.Ceil(float64(dataCount) * math.Min(parityRatio, fec.MAX_PARITY_RATIO)))
+	if dataCount+parityCount > fec.MAX_SHARDS {
+		parityCount = fec.MAX_SHARDS - dataCount
+	}
+	if parityCount < 1 {
+		return
 	}
 
-	return FragmentationTable{
-		packets: packets,
+	shardSize := (payloadSize + dataCount - 1) / dataCount
+	payload := make([]byte, dataCount*shardSize)
+	binary.BigEndian.PutUint16(payload, uint16(len(datagram)))
+	copy(payload[fecLengthSize:], datagram)
+
+	shards := make([][]byte, dataCount)
+	for i := range shards {
+		shards[i] = payload[i*shardSize : (i+1)*shardSize]
 	}
+
+	parity, err := fec.Encode(shards, parityCount)
+	if err != nil {
+		return
+	}
+
+	for i, shard := range append(shards, parity...) {
+		fragments = append(fragments, Fragment{
+			Header: FragmentationHeader{
+				ID:        id,
+				Index:     uint16(i),
+				DataCount: uint16(dataCount),
+			},
+			Data: shard,
+		})
+	}
+
+	return
 }
 
 func (t *FragmentationTable) FeedFragment(header FragmentationHeader, data []byte) (completePacket []byte, err error) {
@@ -61,43 +288,157 @@ func (t *FragmentationTable) FeedFragment(header FragmentationHeader, data []byt
 		return
 	}
 
-	packet := &t.packets[header.ID]
-	packet.lock.Lock()
-	defer packet.lock.Unlock()
+	index := int(header.Index)
+	dataCount := int(header.DataCount)
+
+	if dataCount != 0 {
+		if dataCount >= fec.MAX_SHARDS || index >= fecShardCount(dataCount) {
+			err = fmt.Errorf("FEC fragment %d->%d out of range for %d data fragments", header.ID, index, dataCount)
+			return
+		}
+
+		// Every shard is the same size, so they had better add up to a datagram
+		if len(data) == 0 || (dataCount-1)*len(data) >= fecLengthSize+request.MAX_DATAGRAM_SIZE {
+			err = fmt.Errorf("FEC fragment %d->%d of %d bytes can't be one of %d data fragments", header.ID, index, len(data), dataCount)
+			return
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	fragment := &packet.fragments[header.Index]
+	now := time.Now()
+	t.expire(now)
+
+	if _, ok := t.finished[header.ID]; ok {
+		// A late resend, or parity we ended up not needing
+		t.stats.Duplicates++
+		return
+	}
+
+	packet := t.packets[header.ID]
+
+	if packet != nil && (packet.dataCount != dataCount || (dataCount != 0 && packet.shardSize != len(data))) {
+		log.Printf("Fragment %d->%d doesn't match the rest of its packet, resetting packet", header.ID, index)
+		t.removePacket(packet)
+		t.stats.Dropped++
+		packet = nil
+	}
 
 	// Something is maybe wrong, we've seen this packet fragment before
-	// I'll just log this for now to understand when it happens, then i might do some other handling
-	if fragment.seen {
-		log.Printf("Seen packet fragment %d->%d twice\n", header.ID, header.Index)
-		if !reflect.DeepEqual(fragment.data, data) {
-			log.Printf("Repeated fragment content differs (%d->%d), resetting packet", header.ID, header.Index)
-			packet.reset()
+	if packet != nil {
+		if seen, ok := packet.fragments[header.Index]; ok {
+			t.stats.Duplicates++
+			if bytes.Equal(seen, data) {
+				return
+			}
+
+			// Most likely, the ID has wrapped around onto a packet we never finished
+			log.Printf("Repeated fragment content differs (%d->%d), resetting packet", header.ID, index)
+			t.removePacket(packet)
+			t.stats.Dropped++
+			packet = nil
 		}
 	}
 
-	*fragment = PacketFragment{
-		data: data,
-		seen: true,
+	if packet == nil {
+		packet = &Packet{
+			id:            header.ID,
+			fragments:     make(map[uint16][]byte),
+			expectedCount: dataCount,
+			dataCount:     dataCount,
+			shardSize:     len(data),
+		}
+		packet.element = t.lru.PushFront(packet)
+		t.packets[header.ID] = packet
+	}
+
+	packet.deadline = now.Add(t.limits.Timeout)
+	t.lru.MoveToFront(packet.element)
+
+	if dataCount == 0 {
+		if packet.expectedCount != 0 && index >= packet.expectedCount {
+			err = fmt.Errorf("fragment %d->%d is past the final fragment (%d)", header.ID, index, packet.expectedCount-1)
+			return
+		}
+
+		if packet.size+len(data) > request.MAX_DATAGRAM_SIZE {
+			t.removePacket(packet)
+			t.stats.Dropped++
+			err = fmt.Errorf("reassembled packet %d would be larger than %d bytes, dropping it", header.ID, request.MAX_DATAGRAM_SIZE)
+			return
+		}
 	}
 
-	packet.receivedCount++
+	packet.fragments[header.Index] = append([]byte{}, data...)
+	packet.size += len(data)
+	packet.cost += len(data) + fragmentCost
+	t.buffered += len(data) + fragmentCost
 
-	if header.IsFinalFragment {
-		packet.expectedCount = header.Index + 1
+	if dataCount == 0 && header.IsFinalFragment {
+		// Anything we've got past the end doesn't belong to this packet
+		for strayIndex, stray := range packet.fragments {
+			if int(strayIndex) > index {
+				delete(packet.fragments, strayIndex)
+				packet.size -= len(stray)
+				packet.cost -= len(stray) + fragmentCost
+				t.buffered -= len(stray) + fragmentCost
+			}
+		}
+		packet.expectedCount = index + 1
 	}
 
-	if packet.receivedCount == packet.expectedCount {
-		// All fragments received, reconstruct the packet
-		allFragments := packet.fragments[:packet.receivedCount]
-		var buff bytes.Buffer
-		for i := range allFragments {
-			buff.Write(allFragments[i].data)
+	if packet.expectedCount != 0 && len(packet.fragments) >= packet.expectedCount {
+		if dataCount != 0 {
+			completePacket, err = packet.decodeFEC()
+		} else {
+			// All fragments received, reconstruct the packet (non-nil, even if it's empty)
+			completePacket = make([]byte, 0, packet.size)
+			for i := 0; i < packet.expectedCount; i++ {
+				completePacket = append(completePacket, packet.fragments[uint16(i)]...)
+			}
 		}
-		completePacket = buff.Bytes()
-		packet.reset()
+
+		t.finish(packet)
+
+		if err != nil {
+			t.stats.Dropped++
+			completePacket = nil
+			err = fmt.Errorf("couldn't rebuild packet %d: %v", header.ID, err)
+			return
+		}
+
+		t.stats.Completed++
+		return
+	}
+
+	t.evict(packet)
+	return
+}
+
+// Rebuilds an FEC packet's datagram out of any dataCount of its fragments
+func (packet *Packet) decodeFEC() (datagram []byte, err error) {
+	shards := make([][]byte, fecShardCount(packet.dataCount))
+	for index, shard := range packet.fragments {
+		shards[index] = shard
+	}
+
+	err = fec.Reconstruct(shards, packet.dataCount)
+	if err != nil {
+		return
+	}
+
+	payload := make([]byte, 0, packet.dataCount*packet.shardSize)
+	for _, shard := range shards[:packet.dataCount] {
+		payload = append(payload, shard...)
+	}
+
+	length := int(binary.BigEndian.Uint16(payload))
+	if fecLengthSize+length > len(payload) {
+		err = fmt.Errorf("length prefix (%d) runs past the %d bytes of data", length, len(payload)-fecLengthSize)
+		return
 	}
 
+	datagram = payload[fecLengthSize : fecLengthSize+length]
 	return
 }
@@ -0,0 +1,134 @@
+package records
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Address records (A, AAAA) are tiny, so a response is spread across many of them.
+// The first byte of every address is its sequence number, the rest is data.
+// The data is prefixed with its length, as the last address is likely to be padded.
+
+const addressLengthPrefix = 2
+const maxAddressRecords = 256
+
+func addressCapacity(budget int, addrSize int) int {
+	count := budget / (rrOverhead + addrSize)
+	if count > maxAddressRecords {
+		count = maxAddressRecords
+	}
+
+	capacity := count*(addrSize-1) - addressLengthPrefix
+	if capacity < 0 {
+		return 0
+	}
+	return capacity
+}
+
+func encodeAddresses(msg []byte, addrSize int) []net.IP {
+	data := make([]byte, addressLengthPrefix+len(msg))
+	binary.BigEndian.PutUint16(data, uint16(len(msg)))
+	copy(data[addressLengthPrefix:], msg)
+
+	chunkSize := addrSize - 1
+	var addrs []net.IP
+
+	for seq := 0; seq*chunkSize < len(data); seq++ {
+		addr := make(net.IP, addrSize)
+		addr[0] = byte(seq)
+		copy(addr[1:], data[seq*chunkSize:])
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+func decodeAddresses(addrs []net.IP) ([]byte, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no usable records in response")
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i][0] < addrs[j][0]
+	})
+
+	var data []byte
+	for i, addr := range addrs {
+		if int(addr[0]) != i {
+			return nil, fmt.Errorf("response records out of sequence (expected %d, got %d)", i, addr[0])
+		}
+		data = append(data, addr[1:]...)
+	}
+
+	if len(data) < addressLengthPrefix {
+		return nil, errors.New("address response too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	data = data[addressLengthPrefix:]
+
+	if length > len(data) {
+		return nil, fmt.Errorf("address response truncated (%d/%d)", len(data), length)
+	}
+
+	return data[:length], nil
+}
+
+type aCodec struct{}
+
+func (aCodec) Capacity(domain string, budget int) int {
+	return addressCapacity(budget, net.IPv4len)
+}
+
+func (aCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range encodeAddresses(msg, net.IPv4len) {
+		rrs = append(rrs, &dns.A{
+			Hdr: header(name, dns.TypeA),
+			A:   addr,
+		})
+	}
+	return rrs
+}
+
+func (aCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	var addrs []net.IP
+	for _, rr := range answers {
+		if a, ok := rr.(*dns.A); ok && a.A.To4() != nil {
+			addrs = append(addrs, a.A.To4())
+		}
+	}
+	return decodeAddresses(addrs)
+}
+
+type aaaaCodec struct{}
+
+func (aaaaCodec) Capacity(domain string, budget int) int {
+	return addressCapacity(budget, net.IPv6len)
+}
+
+func (aaaaCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range encodeAddresses(msg, net.IPv6len) {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  header(name, dns.TypeAAAA),
+			AAAA: addr,
+		})
+	}
+	return rrs
+}
+
+func (aaaaCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	var addrs []net.IP
+	for _, rr := range answers {
+		if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To16() != nil {
+			addrs = append(addrs, aaaa.AAAA.To16())
+		}
+	}
+	return decodeAddresses(addrs)
+}
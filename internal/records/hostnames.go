@@ -0,0 +1,188 @@
+package records
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+	"github.com/miekg/dns"
+)
+
+// Hostname-based records (CNAME, MX, SRV) carry base32 labels beneath the tunnel domain.
+// Resolvers may shuffle the order of records in an answer, so when we need more than one,
+// the preference/priority field holds its sequence number.
+
+const maxHostnameLength = 253
+
+// How many bytes we can encode into one hostname beneath domain, if it can use up to budget bytes of rdata
+func hostnameCapacity(domain string, budget int) int {
+	// on the wire, a name costs two more bytes than its presentation form
+	avail := maxHostnameLength
+	if budget-2 < avail {
+		avail = budget - 2
+	}
+	avail -= len(strings.TrimSuffix(domain, ".")) + 1
+
+	if avail <= 0 {
+		return 0
+	}
+
+	// we need to place a period every 63 characters
+	chars := avail - avail/64
+	return chars * 5 / 8
+}
+
+// How many bytes fit into as many hostname records as budget allows, where each record has fixedRdata bytes besides the name
+func multiHostnameCapacity(domain string, budget int, fixedRdata int) int {
+	fullCost := rrOverhead + fixedRdata + maxHostnameLength + 2
+	perName := hostnameCapacity(domain, maxHostnameLength+2)
+
+	count := budget / fullCost
+	remaining := budget - count*fullCost - rrOverhead - fixedRdata
+
+	return count*perName + hostnameCapacity(domain, remaining)
+}
+
+func encodeHostname(domain string, msg []byte) string {
+	return request.EncodeRequest(msg) + "." + dns.Fqdn(domain)
+}
+
+func decodeHostname(domain string, name string) ([]byte, error) {
+	suffix := "." + strings.ToUpper(dns.Fqdn(domain))
+	upperName := strings.ToUpper(dns.Fqdn(name))
+
+	if !strings.HasSuffix(upperName, suffix) {
+		return nil, fmt.Errorf("hostname %s isn't beneath %s", name, domain)
+	}
+
+	return request.DecodeRequest(strings.TrimSuffix(upperName, suffix))
+}
+
+// Splits msg into chunks of hostnames, no bigger than the largest hostname we can make
+func chunkHostnames(domain string, msg []byte) []string {
+	perName := hostnameCapacity(domain, maxHostnameLength+2)
+	var names []string
+
+	for start := 0; start < len(msg); start += perName {
+		end := start + perName
+		if end > len(msg) {
+			end = len(msg)
+		}
+		names = append(names, encodeHostname(domain, msg[start:end]))
+	}
+
+	return names
+}
+
+type sequencedName struct {
+	seq  uint16
+	name string
+}
+
+func decodeSequencedNames(domain string, names []sequencedName) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no usable records in response")
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].seq < names[j].seq
+	})
+
+	var msg []byte
+	for i, n := range names {
+		if int(n.seq) != i {
+			return nil, fmt.Errorf("response records out of sequence (expected %d, got %d)", i, n.seq)
+		}
+
+		chunk, err := decodeHostname(domain, n.name)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+
+	return msg, nil
+}
+
+// CNAME: only a single record is allowed per name
+type cnameCodec struct{}
+
+func (cnameCodec) Capacity(domain string, budget int) int {
+	return hostnameCapacity(domain, budget-rrOverhead)
+}
+
+func (cnameCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	return []dns.RR{&dns.CNAME{
+		Hdr:    header(name, dns.TypeCNAME),
+		Target: encodeHostname(domain, msg),
+	}}
+}
+
+func (cnameCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	for _, rr := range answers {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return decodeHostname(domain, cname.Target)
+		}
+	}
+	return nil, errors.New("no cname record in response")
+}
+
+// MX: preference is the sequence number
+type mxCodec struct{}
+
+func (mxCodec) Capacity(domain string, budget int) int {
+	return multiHostnameCapacity(domain, budget, 2)
+}
+
+func (mxCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	var rrs []dns.RR
+	for i, target := range chunkHostnames(domain, msg) {
+		rrs = append(rrs, &dns.MX{
+			Hdr:        header(name, dns.TypeMX),
+			Preference: uint16(i),
+			Mx:         target,
+		})
+	}
+	return rrs
+}
+
+func (mxCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	var names []sequencedName
+	for _, rr := range answers {
+		if mx, ok := rr.(*dns.MX); ok {
+			names = append(names, sequencedName{seq: mx.Preference, name: mx.Mx})
+		}
+	}
+	return decodeSequencedNames(domain, names)
+}
+
+// SRV: priority is the sequence number
+type srvCodec struct{}
+
+func (srvCodec) Capacity(domain string, budget int) int {
+	return multiHostnameCapacity(domain, budget, 6)
+}
+
+func (srvCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	var rrs []dns.RR
+	for i, target := range chunkHostnames(domain, msg) {
+		rrs = append(rrs, &dns.SRV{
+			Hdr:      header(name, dns.TypeSRV),
+			Priority: uint16(i),
+			Target:   target,
+		})
+	}
+	return rrs
+}
+
+func (srvCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	var names []sequencedName
+	for _, rr := range answers {
+		if srv, ok := rr.(*dns.SRV); ok {
+			names = append(names, sequencedName{seq: srv.Priority, name: srv.Target})
+		}
+	}
+	return decodeSequencedNames(domain, names)
+}
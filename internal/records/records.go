@@ -0,0 +1,211 @@
+package records
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+	"github.com/miekg/dns"
+)
+
+// A RecordCodec carries tunnel responses in the answer section of one DNS record type
+type RecordCodec interface {
+	// Capacity is the largest response (in bytes) that fits in budget bytes of answer section
+	Capacity(domain string, budget int) int
+	Encode(name string, domain string, msg []byte) []dns.RR
+	Decode(domain string, answers []dns.RR) ([]byte, error)
+}
+
+const headerSize = 12
+
+// Question section for the longest possible name, plus type and class.
+// Responses get chunked before we know which query they'll answer, so we always size for the worst case.
+const maxQuestionSize = 255 + 4
+
+// Owner name (a compression pointer back to the question), then type, class, ttl and rdata length
+const rrOverhead = 2 + 2 + 2 + 4 + 2
+
+// Root owner name, then type, class, ttl and rdata length, with no options
+const optSize = 1 + 2 + 2 + 4 + 2
+
+var codecs = map[uint16]RecordCodec{
+	dns.TypeTXT:   txtCodec{},
+	dns.TypeCNAME: cnameCodec{},
+	dns.TypeMX:    mxCodec{},
+	dns.TypeSRV:   srvCodec{},
+	dns.TypeNULL:  nullCodec{},
+	dns.TypeA:     aCodec{},
+	dns.TypeAAAA:  aaaaCodec{},
+}
+
+func GetCodec(qtype uint16) (codec RecordCodec, ok bool) {
+	codec, ok = codecs[qtype]
+	return
+}
+
+// The record types we can tunnel over, smallest first, for telling the other end about
+func Types() []uint16 {
+	types := make([]uint16, 0, len(codecs))
+	for qtype := range codecs {
+		types = append(types, qtype)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
+
+func ParseRecordType(name string) (qtype uint16, err error) {
+	qtype, ok := dns.StringToType[strings.ToUpper(name)]
+	if !ok {
+		err = fmt.Errorf("unknown record type %q", name)
+		return
+	}
+
+	if _, ok = codecs[qtype]; !ok {
+		err = fmt.Errorf("record type %s can't be used for tunnelling", name)
+	}
+	return
+}
+
+// How many bytes of answer section we have to play with in a message of msgSize bytes (leaving room for an EDNS0 OPT record)
+func AnswerBudget(msgSize int) int {
+	return msgSize - headerSize - maxQuestionSize - optSize
+}
+
+func header(name string, qtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    0,
+	}
+}
+
+// TXT: base64, split into as many character-strings and records as we need.
+// Record order isn't guaranteed, so the first character of every record is its sequence number (in the base64 alphabet).
+type txtCodec struct{}
+
+const txtStringLength = 255
+const txtStringsPerRecord = 4
+const txtMaxRecords = 64
+const txtCharsPerRecord = txtStringsPerRecord*txtStringLength - 1
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+func (txtCodec) Capacity(domain string, budget int) int {
+	fullCost := rrOverhead + txtStringsPerRecord*(1+txtStringLength)
+
+	count := budget / fullCost
+	if count >= txtMaxRecords {
+		return base64.RawURLEncoding.DecodedLen(txtMaxRecords * txtCharsPerRecord)
+	}
+
+	chars := count * txtCharsPerRecord
+
+	// every 255 characters costs us a length byte, and we lose one to the sequence number
+	remaining := budget - count*fullCost - rrOverhead
+	if remaining > 1 {
+		remaining -= (remaining + txtStringLength) / (txtStringLength + 1)
+		chars += remaining - 1
+	}
+
+	return base64.RawURLEncoding.DecodedLen(chars)
+}
+
+func (txtCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	encoded := request.EncodeResponse(msg)
+	var rrs []dns.RR
+
+	for seq := 0; seq == 0 || seq*txtCharsPerRecord < len(encoded); seq++ {
+		end := (seq + 1) * txtCharsPerRecord
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		data := base64Alphabet[seq:seq+1] + encoded[seq*txtCharsPerRecord:end]
+
+		var txt []string
+		for i := 0; i < len(data); i += txtStringLength {
+			j := i + txtStringLength
+			if j > len(data) {
+				j = len(data)
+			}
+			txt = append(txt, data[i:j])
+		}
+
+		rrs = append(rrs, &dns.TXT{
+			Hdr: header(name, dns.TypeTXT),
+			Txt: txt,
+		})
+	}
+
+	return rrs
+}
+
+func (txtCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	var chunks []string
+
+	for _, rr := range answers {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		data := strings.Join(txt.Txt, "")
+		if len(data) == 0 {
+			return nil, errors.New("empty txt response")
+		}
+
+		seq := strings.IndexByte(base64Alphabet, data[0])
+		if seq < 0 || seq >= txtMaxRecords {
+			return nil, fmt.Errorf("invalid txt sequence number %q", data[0])
+		}
+
+		for len(chunks) <= seq {
+			chunks = append(chunks, "")
+		}
+		chunks[seq] = data[1:]
+	}
+
+	if len(chunks) == 0 {
+		return nil, errors.New("no txt record in response")
+	}
+
+	for i := range chunks[:len(chunks)-1] {
+		if len(chunks[i]) != txtCharsPerRecord {
+			return nil, fmt.Errorf("txt record %d missing or short", i)
+		}
+	}
+
+	return request.DecodeResponse(strings.Join(chunks, ""))
+}
+
+// NULL: raw bytes, no encoding required
+type nullCodec struct{}
+
+func (nullCodec) Capacity(domain string, budget int) int {
+	n := budget - rrOverhead
+	if n > dns.MaxMsgSize {
+		n = dns.MaxMsgSize
+	}
+	return n
+}
+
+func (nullCodec) Encode(name string, domain string, msg []byte) []dns.RR {
+	return []dns.RR{&dns.NULL{
+		Hdr:  header(name, dns.TypeNULL),
+		Data: string(msg),
+	}}
+}
+
+func (nullCodec) Decode(domain string, answers []dns.RR) ([]byte, error) {
+	for _, rr := range answers {
+		if null, ok := rr.(*dns.NULL); ok {
+			return []byte(null.Data), nil
+		}
+	}
+	return nil, errors.New("no null record in response")
+}
@@ -0,0 +1,246 @@
+package request
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The version of the protocol this build speaks. Session open requests and responses start with it,
+// and the server won't open a session for a client speaking any other version.
+// Anything optional goes in the capabilities instead, so it can change without a version bump.
+const PROTOCOL_VERSION = 1
+
+// Capabilities go over the wire as TLVs: a type byte, a length byte, then the value.
+// Types the receiver doesn't know are skipped, and missing ones take their defaults (see DefaultCapabilities),
+// which keeps the open request small enough to fit in a query.
+const (
+	CAP_ENCODINGS    = 1 // query encodings, a byte each, most preferred first
+	CAP_RECORD_TYPES = 2 // record types, as a bitmask over capRecordTypes (two bytes)
+	CAP_MAX_DATAGRAM = 3 // the largest datagram the sender will take (two bytes)
+	CAP_FEC          = 4 // parity fragments per data fragment, as a percentage (one byte)
+	CAP_ENCRYPTION   = 5 // data encryption modes, a byte each, most preferred first
+)
+
+const (
+	ENCODING_BASE32HEX = 1 // see EncodeRequest
+)
+
+const (
+	ENCRYPTION_NONE             = 0
+	ENCRYPTION_CHACHA20POLY1305 = 1 // see DataCipher
+)
+
+// For the logs
+var (
+	encodingNames   = map[uint8]string{ENCODING_BASE32HEX: "base32hex"}
+	encryptionNames = map[uint8]string{ENCRYPTION_NONE: "none", ENCRYPTION_CHACHA20POLY1305: "chacha20-poly1305"}
+)
+
+// Bit i of the record types bitmask is capRecordTypes[i]. Only ever add to the end.
+var capRecordTypes = []uint16{dns.TypeTXT, dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeNULL, dns.TypeA, dns.TypeAAAA}
+
+// What one end can do. In a session open request, it's what the client offers (in its order of preference),
+// and in the response, it's what the server settled on, with one of each list (but every record type they have in common).
+type Capabilities struct {
+	Encodings   []uint8
+	RecordTypes []uint16
+	MaxDatagram int
+	FECRatio    float64
+	Encryption  []uint8
+}
+
+// What's assumed for anything that isn't sent
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		Encodings:   []uint8{ENCODING_BASE32HEX},
+		RecordTypes: []uint16{dns.TypeTXT}, // what every server has always answered with
+		MaxDatagram: MAX_DATAGRAM_SIZE,
+		Encryption:  []uint8{ENCRYPTION_NONE},
+	}
+}
+
+func (c Capabilities) Encrypted() bool {
+	return len(c.Encryption) > 0 && c.Encryption[0] == ENCRYPTION_CHACHA20POLY1305
+}
+
+func (c Capabilities) HasRecordType(qtype uint16) bool {
+	for _, t := range c.RecordTypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) recordTypeBits() (typeBits uint16) {
+	for i, t := range capRecordTypes {
+		if c.HasRecordType(t) {
+			typeBits |= 1 << i
+		}
+	}
+	return
+}
+
+func nameAll(ids []uint8, names map[uint8]string) string {
+	var named []string
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			name = fmt.Sprintf("unknown (%d)", id)
+		}
+		named = append(named, name)
+	}
+	return strings.Join(named, "/")
+}
+
+func (c Capabilities) String() string {
+	var types []string
+	for _, t := range c.RecordTypes {
+		types = append(types, dns.TypeToString[t])
+	}
+
+	return fmt.Sprintf("encoding %s, records %s, max datagram %d, FEC ratio %.2f, encryption %s", nameAll(c.Encodings, encodingNames), strings.Join(types, "/"), c.MaxDatagram, c.FECRatio, nameAll(c.Encryption, encryptionNames))
+}
+
+func writeCapability(buff *bytes.Buffer, capType byte, value []byte) {
+	buff.WriteByte(capType)
+	buff.WriteByte(byte(len(value)))
+	buff.Write(value)
+}
+
+// Anything that's the same as its default is left out
+func (c Capabilities) Marshal() []byte {
+	var buff bytes.Buffer
+	defaults := DefaultCapabilities()
+
+	if !bytes.Equal(c.Encodings, defaults.Encodings) {
+		writeCapability(&buff, CAP_ENCODINGS, c.Encodings)
+	}
+
+	if typeBits := c.recordTypeBits(); typeBits != defaults.recordTypeBits() {
+		writeCapability(&buff, CAP_RECORD_TYPES, fixedSizeMarshal(typeBits))
+	}
+
+	if c.MaxDatagram != defaults.MaxDatagram {
+		writeCapability(&buff, CAP_MAX_DATAGRAM, fixedSizeMarshal(uint16(c.MaxDatagram)))
+	}
+
+	percent := math.Round(c.FECRatio * 100)
+	if percent > math.MaxUint8 {
+		percent = math.MaxUint8
+	}
+	if percent > 0 {
+		writeCapability(&buff, CAP_FEC, []byte{byte(percent)})
+	}
+
+	if !bytes.Equal(c.Encryption, defaults.Encryption) {
+		writeCapability(&buff, CAP_ENCRYPTION, c.Encryption)
+	}
+
+	return buff.Bytes()
+}
+
+func UnmarshalCapabilities(msg []byte) (c Capabilities, err error) {
+	c = DefaultCapabilities()
+
+	for len(msg) > 0 {
+		if len(msg) < 2 || len(msg) < 2+int(msg[1]) {
+			err = ErrMalformed.WithDetail("capability truncated")
+			return
+		}
+
+		capType := msg[0]
+		value := msg[2 : 2+int(msg[1])]
+		msg = msg[2+len(value):]
+
+		switch capType {
+		case CAP_ENCODINGS:
+			c.Encodings = value
+		case CAP_RECORD_TYPES:
+			if len(value) != 2 {
+				err = ErrMalformed.WithDetail("record types capability should be 2 bytes")
+				return
+			}
+			typeBits := binary.BigEndian.Uint16(value)
+			c.RecordTypes = nil
+			for i, t := range capRecordTypes {
+				if typeBits&(1<<i) != 0 {
+					c.RecordTypes = append(c.RecordTypes, t)
+				}
+			}
+		case CAP_MAX_DATAGRAM:
+			if len(value) != 2 {
+				err = ErrMalformed.WithDetail("max datagram capability should be 2 bytes")
+				return
+			}
+			c.MaxDatagram = int(binary.BigEndian.Uint16(value))
+		case CAP_FEC:
+			if len(value) != 1 {
+				err = ErrMalformed.WithDetail("FEC capability should be 1 byte")
+				return
+			}
+			c.FECRatio = float64(value[0]) / 100
+		case CAP_ENCRYPTION:
+			c.Encryption = value
+		}
+	}
+
+	return
+}
+
+// The first of offered that's also in supported
+func firstCommon(offered []uint8, supported []uint8) (choice uint8, ok bool) {
+	for _, o := range offered {
+		if bytes.IndexByte(supported, o) >= 0 {
+			return o, true
+		}
+	}
+	return 0, false
+}
+
+// Settles on the best of what the client offered that we support, going by the client's preferences.
+// Fails with ErrIncompatible if there's something we can't agree on.
+func Settle(offered Capabilities, supported Capabilities) (settled Capabilities, err error) {
+	encoding, ok := firstCommon(offered.Encodings, supported.Encodings)
+	if !ok {
+		err = ErrIncompatible.WithDetail("no query encoding in common (client offered %s, server supports %s)", nameAll(offered.Encodings, encodingNames), nameAll(supported.Encodings, encodingNames))
+		return
+	}
+
+	encryption, ok := firstCommon(offered.Encryption, supported.Encryption)
+	if !ok {
+		err = ErrIncompatible.WithDetail("no encryption mode in common (client offered %s, server supports %s)", nameAll(offered.Encryption, encryptionNames), nameAll(supported.Encryption, encryptionNames))
+		return
+	}
+
+	settled = Capabilities{
+		Encodings:   []uint8{encoding},
+		MaxDatagram: offered.MaxDatagram,
+		FECRatio:    offered.FECRatio,
+		Encryption:  []uint8{encryption},
+	}
+
+	for _, t := range offered.RecordTypes {
+		if supported.HasRecordType(t) {
+			settled.RecordTypes = append(settled.RecordTypes, t)
+		}
+	}
+	if len(settled.RecordTypes) == 0 {
+		err = ErrIncompatible.WithDetail("no record type in common")
+		return
+	}
+
+	if supported.MaxDatagram < settled.MaxDatagram {
+		settled.MaxDatagram = supported.MaxDatagram
+	}
+	if supported.FECRatio < settled.FECRatio {
+		settled.FECRatio = supported.FECRatio
+	}
+
+	return
+}
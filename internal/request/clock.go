@@ -0,0 +1,62 @@
+package request
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+)
+
+const TIME_PROBE_NONCE_SIZE = 16
+
+// Asks the server for its time. Anyone can ask, but the answer is signed under the key,
+// so a client with a badly wrong clock can still trust it (and it can't be replayed, as it covers the nonce).
+type TimeProbeRequest struct {
+	KeyID KeyID
+	Nonce [TIME_PROBE_NONCE_SIZE]byte
+}
+
+func NewTimeProbeRequest(key *Key) (req TimeProbeRequest, err error) {
+	req.KeyID = key.ID
+	_, err = rand.Read(req.Nonce[:])
+	return
+}
+
+func UnmarshalTimeProbeRequest(msg []byte) (TimeProbeRequest, error) {
+	return fixedSizeUnmarshalRequest[TimeProbeRequest](msg, "time probe")
+}
+
+func (r TimeProbeRequest) Marshal() []byte {
+	return fixedSizeMarshal(r)
+}
+
+type TimeProbeResponse struct {
+	TimeMS uint64 // milliseconds since the epoch
+	MAC    [MAC_SIZE]byte
+}
+
+func (r TimeProbeResponse) Time() time.Time {
+	return time.UnixMilli(int64(r.TimeMS))
+}
+
+func (r TimeProbeResponse) signedBytes(req TimeProbeRequest) []byte {
+	return append(req.Marshal(), fixedSizeMarshal(r.TimeMS)...)
+}
+
+// Key is the one the request asked for
+func (r TimeProbeResponse) Marshal(key *Key, req TimeProbeRequest) []byte {
+	r.MAC = computeMAC(key.clock, MAC_LABEL_TIME, r.signedBytes(req))
+	return fixedSizeMarshal(r)
+}
+
+// Fails if the response wasn't signed under key, for the request we sent
+func UnmarshalTimeProbeResponse(msg []byte, key *Key, req TimeProbeRequest) (res TimeProbeResponse, err error) {
+	res, err = fixedSizeUnmarshal[TimeProbeResponse](msg)
+	if err != nil {
+		return
+	}
+
+	if !checkMAC(key.clock, MAC_LABEL_TIME, res.signedBytes(req), res.MAC) {
+		err = errors.New("time probe response failed authentication")
+	}
+	return
+}
@@ -1,46 +1,188 @@
 package request
 
 import (
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"errors"
+	"encoding/binary"
+	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
-func EncryptMessage(msg []byte, psk string) (encryptedMsg []byte, err error) {
-	key := sha256.Sum256([]byte(psk))
-	aead, err := chacha20poly1305.NewX(key[:])
+// The client sends a random secret in its (encrypted) open request, and both ends derive the session's key from it.
+// Writes, polls and closes carry a truncated MAC under that key, so seeing a session ID isn't enough to use the session.
+const (
+	SESSION_SECRET_SIZE = 32
+	SESSION_KEY_SIZE    = 32
+	MAC_SIZE            = 8
+)
 
-	if err != nil {
+// Mixed into each MAC, so one kind of message can't pass for another
+const (
+	MAC_LABEL_WRITE = 'W'
+	MAC_LABEL_POLL  = 'P'
+	MAC_LABEL_CLOSE = 'C'
+	MAC_LABEL_TIME  = 'T'
+)
+
+func NewSessionSecret() (secret []byte, err error) {
+	secret = make([]byte, SESSION_SECRET_SIZE)
+	_, err = rand.Read(secret)
+	return
+}
+
+func DeriveSessionKey(secret []byte, id SessionID) []byte {
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, id)
+
+	key := make([]byte, SESSION_KEY_SIZE)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("dnsmuggle session key")), key)
+	return key
+}
+
+// Sealed data messages carry the 16-byte AEAD tag, and their nonce comes from the write's counter (which every write carries)
+const (
+	DATA_CIPHER_OVERHEAD = chacha20poly1305.Overhead
+	DATA_COUNTER_SIZE    = 4
+)
+
+// Seals the data messages going one way through a session, when it's encrypted.
+// Nonces are a counter the receiver already knows (the downstream sequence number), or is told in four bytes (writes),
+// rather than 24 random bytes on every message. Each direction has its own key, so they can count independently.
+type DataCipher struct {
+	aead cipher.AEAD
+	id   []byte // additional data, so messages can't be moved between sessions
+}
+
+func newDataCipher(secret []byte, id SessionID, direction string) *DataCipher {
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, id)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("dnsmuggle "+direction+" data key")), key)
+
+	// Only fails for the wrong key size
+	aead, _ := chacha20poly1305.New(key)
+
+	return &DataCipher{
+		aead: aead,
+		id:   salt,
+	}
+}
+
+func NewDataCiphers(secret []byte, id SessionID) (upstream *DataCipher, downstream *DataCipher) {
+	return newDataCipher(secret, id, "upstream"), newDataCipher(secret, id, "downstream")
+}
+
+func (c *DataCipher) nonce(counter uint32) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], counter)
+	return nonce
+}
+
+// Every counter must only ever seal one message (sealing the same message again is fine, as it comes out the same)
+func (c *DataCipher) Seal(counter uint32, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nonce(counter), plaintext, c.id)
+}
+
+func (c *DataCipher) Open(counter uint32, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(counter), ciphertext, c.id)
+}
+
+func computeMAC(key []byte, label byte, msg []byte) (mac [MAC_SIZE]byte) {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{label})
+	h.Write(msg)
+	copy(mac[:], h.Sum(nil))
+	return
+}
+
+func checkMAC(key []byte, label byte, msg []byte, mac [MAC_SIZE]byte) bool {
+	expected := computeMAC(key, label, msg)
+	return hmac.Equal(expected[:], mac[:])
+}
+
+// Control messages start with the key ID, the sending client's ID, and that client's counter, then the ciphertext.
+// The client ID and counter make up the nonce, so a client never reuses one, and the server can spot replays
+// (and drop them before spending any time decrypting) with a window per client, rather than remembering every message.
+type ControlHeader struct {
+	KeyID    KeyID
+	ClientID uint64 // random, picked by each client when it starts
+	Counter  uint64 // counts up with every control message the client sends
+}
+
+const CONTROL_HEADER_SIZE = KEY_ID_SIZE + 8 + 8
+
+func UnmarshalControlHeader(encryptedMsg []byte) (header ControlHeader, err error) {
+	if len(encryptedMsg) < CONTROL_HEADER_SIZE {
+		err = ErrMalformed.WithDetail("encrypted message was too short (< control header size)")
 		return
 	}
 
-	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
-	_, err = rand.Read(nonce)
+	header = ControlHeader{
+		KeyID:    binary.BigEndian.Uint16(encryptedMsg[0:2]),
+		ClientID: binary.BigEndian.Uint64(encryptedMsg[2:10]),
+		Counter:  binary.BigEndian.Uint64(encryptedMsg[10:18]),
+	}
+	return
+}
+
+func (h ControlHeader) Marshal() []byte {
+	buff := make([]byte, CONTROL_HEADER_SIZE)
+	binary.BigEndian.PutUint16(buff[0:2], h.KeyID)
+	binary.BigEndian.PutUint64(buff[2:10], h.ClientID)
+	binary.BigEndian.PutUint64(buff[10:18], h.Counter)
+	return buff
+}
+
+// The client ID and counter, padded out to XChaCha's 24 bytes
+func (h ControlHeader) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, h.Marshal()[KEY_ID_SIZE:])
+	return nonce
+}
+
+// Header's key ID is filled in from key
+func EncryptMessage(msg []byte, key *Key, header ControlHeader) (encryptedMsg []byte, err error) {
+	aead, err := chacha20poly1305.NewX(key.control)
 
 	if err != nil {
 		return
 	}
 
-	encryptedMsg = aead.Seal(nonce, nonce, msg, nil)
+	header.KeyID = key.ID
+	encryptedMsg = header.Marshal()
+
+	// The key ID is additional data, so it can't be swapped out (and the rest of the header is in the nonce)
+	encryptedMsg = aead.Seal(encryptedMsg, header.nonce(), msg, encryptedMsg[:KEY_ID_SIZE])
 	return
 }
 
-func DecryptMessage(encryptedMsg []byte, psk string) (msg []byte, err error) {
-	key := sha256.Sum256([]byte(psk))
-	aead, err := chacha20poly1305.NewX(key[:])
-
+// Decrypts with whichever of the keys the message says it's under, returning that key and the message's header too
+func DecryptMessage(encryptedMsg []byte, keys *Keyring) (msg []byte, key *Key, header ControlHeader, err error) {
+	header, err = UnmarshalControlHeader(encryptedMsg)
 	if err != nil {
 		return
 	}
 
-	if len(encryptedMsg) < aead.NonceSize() {
-		err = errors.New("encrypted message was too short (< nonce size)")
+	key, ok := keys.Get(header.KeyID)
+	if !ok {
+		err = ErrUnknownKey.WithDetail("key ID %d", header.KeyID)
 		return
 	}
 
-	nonce, ciphertext := encryptedMsg[:aead.NonceSize()], encryptedMsg[aead.NonceSize():]
+	aead, err := chacha20poly1305.NewX(key.control)
 
-	return aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return
+	}
+
+	msg, err = aead.Open(nil, header.nonce(), encryptedMsg[CONTROL_HEADER_SIZE:], encryptedMsg[:KEY_ID_SIZE])
+	if err != nil {
+		err = ErrAuthFailed.WithDetail("couldn't decrypt control message")
+	}
+	return
 }
@@ -0,0 +1,132 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every response starts with one of these, so the client knows whether it got what it asked for or an error instead
+const (
+	RESPONSE_OK    = 0
+	RESPONSE_ERROR = 1
+)
+
+const RESPONSE_HEADER_SIZE = 1
+
+// What the server answers with when it can't handle a request, whatever kind it was.
+// It's RESPONSE_ERROR, then the code, then an optional human-readable detail.
+const ERROR_RESPONSE_MIN_SIZE = RESPONSE_HEADER_SIZE + 1
+
+// Spelled out, like the header bytes (see REQ_HEADER_CTRL)
+const (
+	ERROR_FAILED              = 0 // anything that doesn't have its own code
+	ERROR_MALFORMED           = 1 // the server couldn't make sense of the request
+	ERROR_UNKNOWN_KEY         = 2 // the server doesn't have the key (it was revoked, or the client's key name is wrong)
+	ERROR_AUTH_FAILED         = 3 // the request didn't decrypt, or its MAC didn't check out
+	ERROR_CLOCK_SKEW          = 4 // the request's timestamp is too far from the server's clock
+	ERROR_REPLAY              = 5 // the server has already seen the request's counter
+	ERROR_BUSY                = 6 // the server is tracking too many clients to take on another
+	ERROR_UNKNOWN_SESSION     = 7 // the server doesn't know the session (it was closed, or the server restarted)
+	ERROR_UNSUPPORTED_VERSION = 8 // the client speaks a different protocol version to the server (see PROTOCOL_VERSION)
+	ERROR_INCOMPATIBLE        = 9 // the client and server have nothing in common for something they need to agree on (see Settle)
+)
+
+var errorCodeNames = []string{
+	ERROR_FAILED:              "request failed",
+	ERROR_MALFORMED:           "malformed request",
+	ERROR_UNKNOWN_KEY:         "unknown key",
+	ERROR_AUTH_FAILED:         "authentication failed",
+	ERROR_CLOCK_SKEW:          "clock skew",
+	ERROR_REPLAY:              "replayed request",
+	ERROR_BUSY:                "server busy",
+	ERROR_UNKNOWN_SESSION:     "unknown session",
+	ERROR_UNSUPPORTED_VERSION: "unsupported protocol version",
+	ERROR_INCOMPATIBLE:        "incompatible capabilities",
+}
+
+// An error response is an error itself, so the server's handlers can return one to have it sent,
+// and the client gets one back from the request that caused it. They match on their codes with errors.Is, so
+//
+//	errors.Is(err, request.ErrUnknownSession)
+//
+// is true whatever the detail is.
+type ErrorResponse struct {
+	Code   uint8
+	Detail string
+}
+
+var (
+	ErrFailed             = ErrorResponse{Code: ERROR_FAILED}
+	ErrMalformed          = ErrorResponse{Code: ERROR_MALFORMED}
+	ErrUnknownKey         = ErrorResponse{Code: ERROR_UNKNOWN_KEY}
+	ErrAuthFailed         = ErrorResponse{Code: ERROR_AUTH_FAILED}
+	ErrClockSkew          = ErrorResponse{Code: ERROR_CLOCK_SKEW}
+	ErrReplay             = ErrorResponse{Code: ERROR_REPLAY}
+	ErrBusy               = ErrorResponse{Code: ERROR_BUSY}
+	ErrUnknownSession     = ErrorResponse{Code: ERROR_UNKNOWN_SESSION}
+	ErrUnsupportedVersion = ErrorResponse{Code: ERROR_UNSUPPORTED_VERSION}
+	ErrIncompatible       = ErrorResponse{Code: ERROR_INCOMPATIBLE}
+)
+
+func (e ErrorResponse) WithDetail(format string, a ...any) ErrorResponse {
+	e.Detail = fmt.Sprintf(format, a...)
+	return e
+}
+
+func (e ErrorResponse) Error() string {
+	name := fmt.Sprintf("error %d", e.Code)
+	if int(e.Code) < len(errorCodeNames) {
+		name = errorCodeNames[e.Code]
+	}
+
+	if e.Detail == "" {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, e.Detail)
+}
+
+func (e ErrorResponse) Is(target error) bool {
+	other, ok := target.(ErrorResponse)
+	return ok && other.Code == e.Code
+}
+
+// Marks body as a response to what was asked, rather than an error
+func OKResponse(body []byte) []byte {
+	return append([]byte{RESPONSE_OK}, body...)
+}
+
+// Returns the body of an OK response, or the ErrorResponse the server answered with instead
+func UnmarshalResponse(msg []byte) (body []byte, err error) {
+	if len(msg) < RESPONSE_HEADER_SIZE {
+		err = errors.New("empty response")
+		return
+	}
+
+	switch msg[0] {
+	case RESPONSE_OK:
+		body = msg[RESPONSE_HEADER_SIZE:]
+	case RESPONSE_ERROR:
+		if len(msg) < ERROR_RESPONSE_MIN_SIZE {
+			err = errors.New("error response too small")
+			return
+		}
+		err = ErrorResponse{
+			Code:   msg[RESPONSE_HEADER_SIZE],
+			Detail: string(msg[ERROR_RESPONSE_MIN_SIZE:]),
+		}
+	default:
+		err = fmt.Errorf("unknown response type %d", msg[0])
+	}
+	return
+}
+
+// The detail is cut short if the whole thing would be longer than capacity
+func (e ErrorResponse) Marshal(capacity int) []byte {
+	msg := []byte{RESPONSE_ERROR, e.Code}
+	msg = append(msg, e.Detail...)
+
+	if len(msg) > capacity && capacity >= ERROR_RESPONSE_MIN_SIZE {
+		msg = msg[:capacity]
+	}
+	return msg
+}
@@ -0,0 +1,269 @@
+package request
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Sessions are opened with a Noise NNpsk0 handshake, carried in the control channel:
+//
+//	-> psk, e  (the open request)
+//	<- e, ee   (the open response)
+//
+// Both ends make a fresh X25519 key for every session, and the session's secret comes from their shared secret,
+// so a leaked PSK doesn't give away the keys of sessions opened before it leaked.
+// Mixing in the PSK means only someone who knows it can start a handshake, or answer one.
+// See https://noiseprotocol.org/noise.html, this only does the one pattern we need.
+const handshakeProtocolName = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+
+// Mixed into the handshake, so it can't be mistaken for some other protocol's
+const handshakePrologue = "dnsmuggle"
+
+const HANDSHAKE_KEY_SIZE = curve25519.PointSize
+
+type Handshake struct {
+	initiator bool
+	psk       []byte
+	// Noise's symmetric state
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+	k  []byte // nil until the first MixKey
+	n  uint64
+	// Our ephemeral key pair, and theirs
+	e      []byte
+	ePub   []byte
+	remote []byte
+	// Set once both ephemerals are mixed in
+	secret []byte
+}
+
+// The key's handshake PSK is separate from its control channel key
+func NewHandshake(key *Key, initiator bool) *Handshake {
+	hs := &Handshake{
+		initiator: initiator,
+		psk:       key.handshake,
+	}
+
+	// The name's longer than a hash, so it gets hashed
+	hs.h = sha256.Sum256([]byte(handshakeProtocolName))
+	hs.ck = hs.h
+	hs.mixHash([]byte(handshakePrologue))
+	return hs
+}
+
+// Noise's HKDF, giving as many outputs as asked for
+func handshakeHKDF(ck []byte, ikm []byte, outputs int) (out [][]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	var prev []byte
+	for i := 1; i <= outputs; i++ {
+		mac = hmac.New(sha256.New, temp)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i)})
+		prev = mac.Sum(nil)
+		out = append(out, prev)
+	}
+	return
+}
+
+func (hs *Handshake) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(hs.h[:])
+	h.Write(data)
+	copy(hs.h[:], h.Sum(nil))
+}
+
+func (hs *Handshake) mixKey(ikm []byte) {
+	out := handshakeHKDF(hs.ck[:], ikm, 2)
+	copy(hs.ck[:], out[0])
+	hs.k = out[1]
+	hs.n = 0
+}
+
+func (hs *Handshake) mixKeyAndHash(ikm []byte) {
+	out := handshakeHKDF(hs.ck[:], ikm, 3)
+	copy(hs.ck[:], out[0])
+	hs.mixHash(out[1])
+	hs.k = out[2]
+	hs.n = 0
+}
+
+func (hs *Handshake) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], hs.n)
+	return nonce
+}
+
+func (hs *Handshake) encryptAndHash(plaintext []byte) []byte {
+	// Only fails for the wrong key size
+	aead, _ := chacha20poly1305.New(hs.k)
+	ciphertext := aead.Seal(nil, hs.nonce(), plaintext, hs.h[:])
+	hs.n++
+	hs.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (hs *Handshake) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	aead, _ := chacha20poly1305.New(hs.k)
+	plaintext, err = aead.Open(nil, hs.nonce(), ciphertext, hs.h[:])
+	if err != nil {
+		err = ErrAuthFailed.WithDetail("handshake message (wrong PSK?)")
+		return
+	}
+	hs.n++
+	hs.mixHash(ciphertext)
+	return
+}
+
+func (hs *Handshake) generateEphemeral() (err error) {
+	hs.e = make([]byte, curve25519.ScalarSize)
+	_, err = rand.Read(hs.e)
+	if err != nil {
+		return
+	}
+
+	hs.ePub, err = curve25519.X25519(hs.e, curve25519.Basepoint)
+	return
+}
+
+// Noise's "e" token, for whichever side is writing
+func (hs *Handshake) writeEphemeral() (msg []byte, err error) {
+	err = hs.generateEphemeral()
+	if err != nil {
+		return
+	}
+
+	hs.mixHash(hs.ePub)
+	// In PSK handshakes, ephemerals are mixed into the key too
+	hs.mixKey(hs.ePub)
+	return hs.ePub, nil
+}
+
+func (hs *Handshake) readEphemeral(msg []byte) (rest []byte, err error) {
+	if len(msg) < HANDSHAKE_KEY_SIZE {
+		err = ErrMalformed.WithDetail("handshake message too small")
+		return
+	}
+
+	hs.remote = msg[:HANDSHAKE_KEY_SIZE]
+	hs.mixHash(hs.remote)
+	hs.mixKey(hs.remote)
+	return msg[HANDSHAKE_KEY_SIZE:], nil
+}
+
+// Noise's "ee" token, which is where the secret comes from
+func (hs *Handshake) mixShared() (err error) {
+	shared, err := curve25519.X25519(hs.e, hs.remote)
+	if err != nil {
+		return
+	}
+
+	hs.mixKey(shared)
+
+	// Noise's Split, of which we only need the first key. It's the session's secret, like the one the PSK-only open sends.
+	hs.secret = handshakeHKDF(hs.ck[:], nil, 2)[0]
+	// We're done with our half
+	hs.e = nil
+	return
+}
+
+// The first message, from the client, carrying payload (readable by anyone with the PSK, so it's not forward secret)
+func (hs *Handshake) WriteRequest(payload []byte) (msg []byte, err error) {
+	if !hs.initiator {
+		err = errors.New("only the initiator writes handshake requests")
+		return
+	}
+
+	hs.mixKeyAndHash(hs.psk)
+
+	msg, err = hs.writeEphemeral()
+	if err != nil {
+		return
+	}
+
+	msg = append(msg, hs.encryptAndHash(payload)...)
+	return
+}
+
+// The server reads the first message, returning its payload
+func (hs *Handshake) ReadRequest(msg []byte) (payload []byte, err error) {
+	if hs.initiator {
+		err = errors.New("only the responder reads handshake requests")
+		return
+	}
+
+	hs.mixKeyAndHash(hs.psk)
+
+	rest, err := hs.readEphemeral(msg)
+	if err != nil {
+		return
+	}
+
+	return hs.decryptAndHash(rest)
+}
+
+// The server makes its half of the handshake, after which the session's secret is ready.
+// It's split from WriteResponse, as the secret is needed to set up whatever the response talks about.
+func (hs *Handshake) Accept() (secret []byte, err error) {
+	if hs.initiator || hs.remote == nil {
+		err = errors.New("can only accept a handshake request that's been read")
+		return
+	}
+
+	_, err = hs.writeEphemeral()
+	if err != nil {
+		return
+	}
+
+	err = hs.mixShared()
+	return hs.secret, err
+}
+
+// The second message, from the server, carrying payload
+func (hs *Handshake) WriteResponse(payload []byte) (msg []byte, err error) {
+	if hs.secret == nil {
+		err = errors.New("handshake hasn't been accepted")
+		return
+	}
+
+	msg = append([]byte{}, hs.ePub...)
+	msg = append(msg, hs.encryptAndHash(payload)...)
+	return
+}
+
+// The client reads the second message, returning its payload. Secret is ready afterwards.
+func (hs *Handshake) ReadResponse(msg []byte) (payload []byte, err error) {
+	if !hs.initiator || hs.ePub == nil {
+		err = errors.New("can only read a response to a handshake request we wrote")
+		return
+	}
+
+	rest, err := hs.readEphemeral(msg)
+	if err != nil {
+		return
+	}
+
+	err = hs.mixShared()
+	if err != nil {
+		return
+	}
+
+	payload, err = hs.decryptAndHash(rest)
+	if err != nil {
+		hs.secret = nil
+	}
+	return
+}
+
+// The session secret both ends agreed on, or nil if the handshake isn't done
+func (hs *Handshake) Secret() []byte {
+	return hs.secret
+}
@@ -2,16 +2,33 @@ package request
 
 import "math"
 
-// One byte for the master header, eight for sess id, two for frag header
-const requestOverhead = 1 + 8 + 2
+// One byte for the master header, the cache-busting nonce, eight for sess id, the MAC, eight for the downstream ack, the counter, then the frag header
+const requestOverhead = 1 + DATA_NONCE_SIZE + 8 + MAC_SIZE + 8 + DATA_COUNTER_SIZE + MAX_FRAG_HEADER_SIZE
+
+// One byte for the status, four for the sequence number, then the frag header
+const responseOverhead = 1 + 4 + MAX_FRAG_HEADER_SIZE
 const periodOverheadRatio = 63.0 / 64.0 // we need to place a period ever 63 characters
 const b32OverheadRatio = 5.0 / 8.0      // base32 loses 3 bits of space efficiency
-const b64OverheadRatio = 6.0 / 8.0
 
-func GetMaxRequestSize(domain string) int {
-	return int(math.Floor(periodOverheadRatio*math.Floor(b32OverheadRatio*float64(254-len(domain))))) - requestOverhead
+// Encrypted writes also carry the AEAD tag
+const encryptedRequestOverhead = DATA_CIPHER_OVERHEAD
+
+// Encrypted responses use their sequence number as the counter, so only carry the tag
+const encryptedResponseOverhead = DATA_CIPHER_OVERHEAD
+
+func GetMaxRequestSize(domain string, encrypted bool) int {
+	size := int(math.Floor(periodOverheadRatio*math.Floor(b32OverheadRatio*float64(254-len(domain))))) - requestOverhead
+	if encrypted {
+		size -= encryptedRequestOverhead
+	}
+	return size
 }
 
-func GetMaxResponseSize() int {
-	return 200 * b64OverheadRatio
+// Capacity is how many bytes the record type we're answering with can carry (see records.RecordCodec)
+func GetMaxResponseSize(capacity int, encrypted bool) int {
+	size := capacity - responseOverhead
+	if encrypted {
+		size -= encryptedResponseOverhead
+	}
+	return size
 }
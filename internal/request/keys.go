@@ -0,0 +1,98 @@
+package request
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Pre-shared keys are passphrases, so they're stretched with Argon2id before we use them.
+// Both ends derive a key once at startup, so we can afford to make guessing expensive.
+const (
+	keyArgonTime    = 3
+	keyArgonMemory  = 64 * 1024 // KiB
+	keyArgonThreads = 4
+	keySize         = 32
+)
+
+// Every control message starts with the ID of the key it's encrypted under, so the server knows which one to use
+const KEY_ID_SIZE = 2
+
+type KeyID = uint16
+
+// The name the server gives -psk's key, and the one clients use unless they're given their own
+const DEFAULT_KEY_NAME = "default"
+
+// A named pre-shared key. Each person (or machine) can have their own, so one can be revoked without re-keying everyone else.
+type Key struct {
+	Name string
+	ID   KeyID
+	// Encrypts control messages
+	control []byte
+	// The PSK mixed into handshakes
+	handshake []byte
+	// Signs the server's answers to time probes
+	clock []byte
+}
+
+// The ID only depends on the name, so it's the same on both ends, and leaks nothing about the passphrase
+func keyIDForName(name string) KeyID {
+	sum := sha256.Sum256([]byte("dnsmuggle key id " + name))
+	return binary.BigEndian.Uint16(sum[:KEY_ID_SIZE])
+}
+
+// The name salts the KDF, so people who picked the same passphrase still end up with different keys
+func DeriveKey(name string, passphrase string) *Key {
+	master := argon2.IDKey([]byte(passphrase), []byte("dnsmuggle key "+name), keyArgonTime, keyArgonMemory, keyArgonThreads, keySize)
+
+	key := &Key{
+		Name:      name,
+		ID:        keyIDForName(name),
+		control:   make([]byte, keySize),
+		handshake: make([]byte, keySize),
+		clock:     make([]byte, keySize),
+	}
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("dnsmuggle control channel")), key.control)
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("dnsmuggle handshake psk")), key.handshake)
+	io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("dnsmuggle time probe")), key.clock)
+	return key
+}
+
+// The keys the server accepts, by ID
+type Keyring struct {
+	keys map[KeyID]*Key
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[KeyID]*Key),
+	}
+}
+
+// Fails if the key's ID is already taken, as the server couldn't tell them apart
+func (r *Keyring) Add(key *Key) error {
+	if existing, ok := r.keys[key.ID]; ok {
+		return fmt.Errorf("keys %s and %s have the same ID (%d), one of them needs a different name", existing.Name, key.Name, key.ID)
+	}
+	r.keys[key.ID] = key
+	return nil
+}
+
+func (r *Keyring) Get(id KeyID) (key *Key, ok bool) {
+	key, ok = r.keys[id]
+	return
+}
+
+// Whether the keyring still has this exact key (same name and passphrase)
+func (r *Keyring) Has(key *Key) bool {
+	current, ok := r.keys[key.ID]
+	return ok && current.Name == key.Name && string(current.control) == string(key.control)
+}
+
+func (r *Keyring) Len() int {
+	return len(r.keys)
+}
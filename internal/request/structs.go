@@ -8,20 +8,24 @@ import (
 	"log"
 )
 
+// Header bytes and statuses go over the wire, so they're spelled out rather than left to iota, and can't be renumbered.
+// Anything that changes what they mean needs a new PROTOCOL_VERSION.
 const (
-	REQ_HEADER_CTRL = iota // encrypted message
-	REQ_HEADER_DATA = iota // normal data flow
+	REQ_HEADER_CTRL = 0 // encrypted message
+	REQ_HEADER_DATA = 1 // normal data flow
+	REQ_HEADER_TIME = 2 // asks for the server's time (see TimeProbeRequest)
 )
 
-const (
-	CTRL_HEADER_SESSION_OPEN  = iota
-	CTRL_HEADER_SESSION_POLL  = iota
-	CTRL_HEADER_SESSION_WRITE = iota
-)
+// Data messages are prefixed with a counter, so identical messages don't get answered out of a resolver's cache.
+// The server ignores it.
+const DATA_NONCE_SIZE = 2
 
 const (
-	RES_HEADER_WRITE_OK = iota
-	RES_HEADER_CLOSED   = iota
+	CTRL_HEADER_SESSION_OPEN      = 0 // PSK-only, where the client sends the session secret
+	CTRL_HEADER_SESSION_POLL      = 1
+	CTRL_HEADER_SESSION_WRITE     = 2
+	CTRL_HEADER_SESSION_CLOSE     = 3
+	CTRL_HEADER_SESSION_HANDSHAKE = 4 // opens a session with a handshake (see Handshake), which makes the secret
 )
 
 type SessionID = uint64
@@ -41,163 +45,538 @@ func fixedSizeUnmarshal[T any](msg []byte) (out T, err error) {
 	return
 }
 
-// Request to create a new session
+// Like fixedSizeUnmarshal, for requests the server reads, so anything too short gets a malformed request error
+func fixedSizeUnmarshalRequest[T any](msg []byte, name string) (out T, err error) {
+	out, err = fixedSizeUnmarshal[T](msg)
+	if err != nil {
+		err = ErrMalformed.WithDetail("%s too small", name)
+	}
+	return
+}
+
+// Request to create a new session.
+// On the wire, both forms start with PROTOCOL_VERSION. The PSK-only form follows it with the secret (see DeriveSessionKey),
+// and the handshake form with the handshake, which makes the secret instead. Then it's the length of the capabilities,
+// the capabilities and the destination (inside the handshake, for that form).
 type SessionOpenRequest struct {
-	DestAddr string
+	// What the client can do, including the FEC ratio it wants the server to start with (see Settle)
+	Capabilities Capabilities
+	Secret       []byte
+	DestAddr     string
 }
 
-func UnmarshalSessionOpenRequest(msg []byte) SessionOpenRequest {
-	return SessionOpenRequest{
-		DestAddr: string(msg),
+// The version is checked before anything else, as the rest might be laid out differently in other versions
+func checkRequestVersion(msg []byte) (rest []byte, err error) {
+	if len(msg) < 1 {
+		err = ErrMalformed.WithDetail("session open request too small")
+		return
+	}
+
+	if msg[0] != PROTOCOL_VERSION {
+		err = ErrUnsupportedVersion.WithDetail("client speaks version %d, server speaks version %d", msg[0], PROTOCOL_VERSION)
+		return
 	}
+
+	return msg[1:], nil
+}
+
+func UnmarshalSessionOpenRequest(msg []byte) (req SessionOpenRequest, err error) {
+	msg, err = checkRequestVersion(msg)
+	if err != nil {
+		return
+	}
+
+	if len(msg) < SESSION_SECRET_SIZE {
+		err = ErrMalformed.WithDetail("session open request too small")
+		return
+	}
+
+	req, err = unmarshalSessionOpenParams(msg[SESSION_SECRET_SIZE:])
+	req.Secret = msg[:SESSION_SECRET_SIZE]
+	return
 }
 
 func (r SessionOpenRequest) Marshal() []byte {
 	var buff bytes.Buffer
 	buff.WriteByte(CTRL_HEADER_SESSION_OPEN)
+	buff.WriteByte(PROTOCOL_VERSION)
+	buff.Write(r.Secret)
+	buff.Write(r.params())
+	return buff.Bytes()
+}
+
+// Everything after the version and the secret, which is what a handshake request carries
+func (r SessionOpenRequest) params() []byte {
+	caps := r.Capabilities.Marshal()
+
+	var buff bytes.Buffer
+	buff.WriteByte(byte(len(caps)))
+	buff.Write(caps)
 	buff.WriteString(r.DestAddr)
 	return buff.Bytes()
 }
 
+func unmarshalSessionOpenParams(msg []byte) (req SessionOpenRequest, err error) {
+	if len(msg) < 1 || len(msg) < 1+int(msg[0]) {
+		err = ErrMalformed.WithDetail("session open request too small")
+		return
+	}
+
+	capsEnd := 1 + int(msg[0])
+	req.Capabilities, err = UnmarshalCapabilities(msg[1:capsEnd])
+	req.DestAddr = string(msg[capsEnd:])
+	return
+}
+
+// Opens a session with the handshake's first message, which carries the request (but not the secret, the handshake makes that).
+// The handshake is left ready for the server to accept.
+func UnmarshalSessionHandshakeRequest(msg []byte, hs *Handshake) (req SessionOpenRequest, err error) {
+	msg, err = checkRequestVersion(msg)
+	if err != nil {
+		return
+	}
+
+	payload, err := hs.ReadRequest(msg)
+	if err != nil {
+		return
+	}
+
+	return unmarshalSessionOpenParams(payload)
+}
+
+// Secret is ignored, as the handshake makes it
+func (r SessionOpenRequest) MarshalHandshake(hs *Handshake) (msg []byte, err error) {
+	hsMsg, err := hs.WriteRequest(r.params())
+	if err != nil {
+		return
+	}
+
+	msg = append([]byte{CTRL_HEADER_SESSION_HANDSHAKE, PROTOCOL_VERSION}, hsMsg...)
+	return
+}
+
 const (
-	SESSION_OPEN_OK        = iota
-	SESSION_OPEN_DIAL_FAIL = iota
-	SESSION_OPEN_ERROR     = iota
+	SESSION_OPEN_OK        = 0
+	SESSION_OPEN_DIAL_FAIL = 1
+	SESSION_OPEN_ERROR     = 2
+	SESSION_OPEN_DENIED    = 3 // the server's ACL doesn't let our key dial there
 )
 
+// On the wire, it's PROTOCOL_VERSION, the status, the ID, then the capabilities the server settled on
 type SessionOpenResponse struct {
 	Status uint8
 	ID     SessionID
+	// Only for SESSION_OPEN_OK
+	Capabilities Capabilities
 }
 
-func UnmarshalSessionOpenResponse(msg []byte) (SessionOpenResponse, error) {
-	return fixedSizeUnmarshal[SessionOpenResponse](msg)
+const sessionOpenResponseSize = 1 + 1 + 8
+
+func UnmarshalSessionOpenResponse(msg []byte) (res SessionOpenResponse, err error) {
+	if len(msg) < 1 {
+		err = errors.New("session open response too small")
+		return
+	}
+
+	if msg[0] != PROTOCOL_VERSION {
+		err = ErrUnsupportedVersion.WithDetail("server speaks version %d, client speaks version %d", msg[0], PROTOCOL_VERSION)
+		return
+	}
+
+	if len(msg) < sessionOpenResponseSize {
+		err = errors.New("session open response too small")
+		return
+	}
+
+	res.Status = msg[1]
+	res.ID = binary.BigEndian.Uint64(msg[2:sessionOpenResponseSize])
+	res.Capabilities, err = UnmarshalCapabilities(msg[sessionOpenResponseSize:])
+	return
 }
 
 func (r SessionOpenResponse) Marshal() []byte {
+	buff := make([]byte, sessionOpenResponseSize)
+	buff[0] = PROTOCOL_VERSION
+	buff[1] = r.Status
+	binary.BigEndian.PutUint64(buff[2:], r.ID)
+	return append(buff, r.Capabilities.Marshal()...)
+}
+
+// The response to a handshake request is the handshake's second message
+func UnmarshalSessionHandshakeResponse(msg []byte, hs *Handshake) (res SessionOpenResponse, err error) {
+	payload, err := hs.ReadResponse(msg)
+	if err != nil {
+		return
+	}
+
+	return UnmarshalSessionOpenResponse(payload)
+}
+
+// The handshake must have been accepted
+func (r SessionOpenResponse) MarshalHandshake(hs *Handshake) ([]byte, error) {
+	return hs.WriteResponse(r.Marshal())
+}
+
+// Request to tear down a session we're done with
+type SessionCloseRequest struct {
+	ID  SessionID
+	MAC [MAC_SIZE]byte
+}
+
+func UnmarshalSessionCloseRequest(msg []byte) (SessionCloseRequest, error) {
+	return fixedSizeUnmarshalRequest[SessionCloseRequest](msg, "session close request")
+}
+
+func (r SessionCloseRequest) signedBytes() []byte {
+	return fixedSizeMarshal(r.ID)
+}
+
+// Whether the MAC checks out under the session's key
+func (r SessionCloseRequest) Authentic(key []byte) bool {
+	return checkMAC(key, MAC_LABEL_CLOSE, r.signedBytes(), r.MAC)
+}
+
+func (r SessionCloseRequest) Marshal(key []byte) []byte {
+	r.MAC = computeMAC(key, MAC_LABEL_CLOSE, r.signedBytes())
+
+	var buff bytes.Buffer
+	buff.WriteByte(CTRL_HEADER_SESSION_CLOSE)
+	buff.Write(fixedSizeMarshal(r))
+	return buff.Bytes()
+}
+
+// If the server had already forgotten about the session, it answers with ErrUnknownSession instead
+const (
+	SESSION_CLOSE_OK = 0
+)
+
+type SessionCloseResponse struct {
+	Status uint8
+}
+
+func UnmarshalSessionCloseResponse(msg []byte) (SessionCloseResponse, error) {
+	return fixedSizeUnmarshal[SessionCloseResponse](msg)
+}
+
+func (r SessionCloseResponse) Marshal() []byte {
 	return fixedSizeMarshal(r)
 }
 
-// Request to ask for new data
+// Acknowledges downstream fragments, so the server knows what it needs to resend.
+// Next is the first sequence number we haven't received (everything before it has arrived),
+// and bit i of Bitmap is set if we've received Next+1+i.
+type DownstreamAck struct {
+	Next   uint32
+	Bitmap uint32
+}
+
+// How far past the last cumulative ack the server may send
+const DOWNSTREAM_WINDOW = 32
+
+// Whether the ack covers seq (sequence numbers wrap around, so we compare them as offsets)
+func (a DownstreamAck) Acks(seq uint32) bool {
+	offset := seq - a.Next
+	if int32(offset) < 0 {
+		return true
+	}
+	if offset == 0 || offset > DOWNSTREAM_WINDOW {
+		return false
+	}
+	return a.Bitmap&(1<<(offset-1)) != 0
+}
+
+// Request to ask for new data.
+// WaitMS is how long the server may hold the poll open waiting for data, which it caps to its own limit.
 type PollRequest struct {
-	ID SessionID
+	ID     SessionID
+	Ack    DownstreamAck
+	WaitMS uint16
+	MAC    [MAC_SIZE]byte
 }
 
 func UnmarshalPollRequest(msg []byte) (PollRequest, error) {
-	return fixedSizeUnmarshal[PollRequest](msg)
+	return fixedSizeUnmarshalRequest[PollRequest](msg, "poll request")
 }
 
-func (r PollRequest) Marshal() []byte {
+// Everything but the MAC
+func (r PollRequest) signedBytes() []byte {
+	r.MAC = [MAC_SIZE]byte{}
+	msg := fixedSizeMarshal(r)
+	return msg[:len(msg)-MAC_SIZE]
+}
+
+// Whether the MAC checks out under the session's key
+func (r PollRequest) Authentic(key []byte) bool {
+	return checkMAC(key, MAC_LABEL_POLL, r.signedBytes(), r.MAC)
+}
+
+func (r PollRequest) Marshal(key []byte) []byte {
+	r.MAC = computeMAC(key, MAC_LABEL_POLL, r.signedBytes())
+
 	var buff bytes.Buffer
 	buff.WriteByte(CTRL_HEADER_SESSION_POLL)
 	buff.Write(fixedSizeMarshal(r))
 	return buff.Bytes()
 }
 
-// Header for fragmentation
+// Header for fragmentation.
+// It starts with a byte holding the version (top four bits) and flags (bottom four bits),
+// then the packet ID and fragment index as uvarints, so small values stay small on the wire.
+// Packets sent with forward error correction have the FEC flag set, and a uvarint count of data fragments on the end.
+// Their first DataCount fragments are the datagram (length-prefixed and padded out), and the rest are parity.
 const (
-	MAX_FRAG_INDEX = 0b11111
-	MAX_FRAG_ID    = 0b1111111111
+	FRAG_HEADER_VERSION = 1
+	FRAG_FLAG_FINAL     = 1 << 0
+	FRAG_FLAG_FEC       = 1 << 1
+
+	MAX_FRAG_ID          = 1<<21 - 1 // three bytes as a uvarint
+	MAX_FRAG_INDEX       = 1<<14 - 1 // two bytes as a uvarint
+	MAX_FRAG_DATA_COUNT  = 1<<14 - 1 // two bytes as a uvarint
+	MAX_FRAG_HEADER_SIZE = 1 + 3 + 2 + 2
+
+	// The largest datagram we might read off a UDP socket
+	MAX_DATAGRAM_SIZE = 65535
 )
 
 type FragmentationHeader struct {
-	ID              uint16
-	Index           uint8
+	ID              uint32
+	Index           uint16
 	IsFinalFragment bool
+	DataCount       uint16 // only for FEC packets, 0 otherwise
 }
 
-func UnmarshalFragmentationHeader(header uint16) FragmentationHeader {
-	return FragmentationHeader{
-		ID:              header >> 6,
-		Index:           uint8((header >> 1) & MAX_FRAG_INDEX),
-		IsFinalFragment: (header & 1) == 1,
+// Returns the header, and how many bytes of msg it took up
+func UnmarshalFragmentationHeader(msg []byte) (header FragmentationHeader, n int, err error) {
+	if len(msg) < 1 {
+		err = ErrMalformed.WithDetail("fragmentation header missing")
+		return
+	}
+
+	version := msg[0] >> 4
+	flags := msg[0] & 0x0F
+
+	if version != FRAG_HEADER_VERSION {
+		err = ErrMalformed.WithDetail("unsupported fragmentation header version %d", version)
+		return
+	}
+
+	id, idLen := binary.Uvarint(msg[1:])
+	if idLen <= 0 || id > MAX_FRAG_ID {
+		err = ErrMalformed.WithDetail("invalid fragmentation header id")
+		return
+	}
+
+	index, indexLen := binary.Uvarint(msg[1+idLen:])
+	if indexLen <= 0 || index > MAX_FRAG_INDEX {
+		err = ErrMalformed.WithDetail("invalid fragmentation header index")
+		return
+	}
+
+	header = FragmentationHeader{
+		ID:              uint32(id),
+		Index:           uint16(index),
+		IsFinalFragment: flags&FRAG_FLAG_FINAL != 0,
 	}
+	n = 1 + idLen + indexLen
+
+	if flags&FRAG_FLAG_FEC != 0 {
+		dataCount, dataCountLen := binary.Uvarint(msg[n:])
+		if dataCountLen <= 0 || dataCount == 0 || dataCount > MAX_FRAG_DATA_COUNT {
+			err = ErrMalformed.WithDetail("invalid fragmentation header data count")
+			return
+		}
+
+		header.DataCount = uint16(dataCount)
+		n += dataCountLen
+	}
+
+	return
 }
 
-func (s FragmentationHeader) Marshal() uint16 {
-	final := uint16(0)
+func (s FragmentationHeader) Marshal() []byte {
+	flags := byte(0)
 	if s.IsFinalFragment {
-		final = 1
+		flags |= FRAG_FLAG_FINAL
+	}
+	if s.DataCount != 0 {
+		flags |= FRAG_FLAG_FEC
 	}
 
-	index := uint16(s.Index & MAX_FRAG_INDEX)
-	id := s.ID & MAX_FRAG_ID
+	buff := make([]byte, MAX_FRAG_HEADER_SIZE)
+	buff[0] = FRAG_HEADER_VERSION<<4 | flags
+	n := 1
+	n += binary.PutUvarint(buff[n:], uint64(s.ID&MAX_FRAG_ID))
+	n += binary.PutUvarint(buff[n:], uint64(s.Index&MAX_FRAG_INDEX))
+	if s.DataCount != 0 {
+		n += binary.PutUvarint(buff[n:], uint64(s.DataCount&MAX_FRAG_DATA_COUNT))
+	}
 
-	return id<<6 | index<<1 | final
+	return buff[:n]
 }
 
 // Response to polling data
 type PollResponse struct {
 	Status              uint8
+	Seq                 uint32
 	FragmentationHeader FragmentationHeader
 	Data                []byte
 }
 
+// Anything that goes wrong is an ErrorResponse instead
 const (
-	POLL_OK      = iota
-	POLL_NO_DATA = iota
-	POLL_ERROR   = iota
+	POLL_OK      = 0
+	POLL_NO_DATA = 1
+	// The server no longer needs to send Seq (the client had enough of an FEC packet to rebuild it without),
+	// so the client should count it as received. It's not sealed, as Seq has already sealed the fragment it replaces,
+	// so someone on the path could forge one, but all that gets them is a lost fragment, which they could do anyway.
+	POLL_SKIP = 2
 )
 
-func UnmarshalPollResponse(msg []byte) (req PollResponse, err error) {
-	if len(msg) < 3 {
-		err = fmt.Errorf("poll response too small (%d)/3", len(msg))
+// Downstream is the session's downstream cipher if it's encrypted, otherwise nil
+func UnmarshalPollResponse(msg []byte, downstream *DataCipher) (req PollResponse, err error) {
+	if len(msg) < 6 {
+		err = fmt.Errorf("poll response too small (%d)/6", len(msg))
 		return
 	}
 
 	req = PollResponse{
-		Status:              msg[0],
-		FragmentationHeader: UnmarshalFragmentationHeader(binary.BigEndian.Uint16(msg[1:3])),
-		Data:                msg[3:],
+		Status: msg[0],
+		Seq:    binary.BigEndian.Uint32(msg[1:5]),
+	}
+
+	fragment := msg[5:]
+	if downstream != nil && req.Status == POLL_OK {
+		fragment, err = downstream.Open(req.Seq, fragment)
+		if err != nil {
+			err = fmt.Errorf("couldn't open poll response %d", req.Seq)
+			return
+		}
+	}
+
+	fragHeader, n, err := UnmarshalFragmentationHeader(fragment)
+	if err != nil {
+		return
 	}
+
+	req.FragmentationHeader = fragHeader
+	req.Data = fragment[n:]
 	return
 }
 
-func (r PollResponse) Marshal() []byte {
-	buff := make([]byte, 1+2+len(r.Data))
+// Only responses carrying data are sealed, with the sequence number as the counter.
+// A resend has the same sequence number and data, so it seals to the same bytes.
+func (r PollResponse) Marshal(downstream *DataCipher) []byte {
+	fragment := append(r.FragmentationHeader.Marshal(), r.Data...)
+	if downstream != nil && r.Status == POLL_OK {
+		fragment = downstream.Seal(r.Seq, fragment)
+	}
+
+	buff := make([]byte, 1+4, 1+4+len(fragment))
 	buff[0] = r.Status
-	binary.BigEndian.PutUint16(buff[1:3], r.FragmentationHeader.Marshal())
-	copy(buff[3:], r.Data)
+	binary.BigEndian.PutUint32(buff[1:5], r.Seq)
+	buff = append(buff, fragment...)
 	return buff
 }
 
-// Request to write data
+// Request to write data.
+// On the wire it's the ID, then the MAC (over everything else), then the ack, the counter and the fragment.
+// The fragment is the frag header and data, sealed under the counter for encrypted sessions.
 type WriteRequest struct {
 	ID                  SessionID
+	MAC                 [MAC_SIZE]byte
+	Ack                 DownstreamAck
+	Counter             uint32 // never repeats within a session, so the server can turn away replays
 	FragmentationHeader FragmentationHeader
 	Data                []byte
 }
 
-func UnmarshalWriteRequest(msg []byte) (req WriteRequest, err error) {
-	if len(msg) < 10 {
-		err = errors.New("writte request too small")
+const writeRequestFragmentStart = 8 + MAC_SIZE + 8 + DATA_COUNTER_SIZE
+
+// The session a write is for, so we know which keys to unmarshal the rest with
+func WriteRequestSessionID(msg []byte) (id SessionID, err error) {
+	if len(msg) < writeRequestFragmentStart+1 {
+		err = ErrMalformed.WithDetail("write request too small")
+		return
+	}
+
+	id = binary.BigEndian.Uint64(msg[:8])
+	return
+}
+
+// Checks the MAC under the session's key before anything else, then opens the fragment if upstream isn't nil
+func UnmarshalWriteRequest(msg []byte, key []byte, upstream *DataCipher) (req WriteRequest, err error) {
+	req.ID, err = WriteRequestSessionID(msg)
+	if err != nil {
+		return
+	}
+
+	copy(req.MAC[:], msg[8:8+MAC_SIZE])
+
+	signed := make([]byte, 0, len(msg)-MAC_SIZE)
+	signed = append(signed, msg[:8]...)
+	signed = append(signed, msg[8+MAC_SIZE:]...)
+
+	if !checkMAC(key, MAC_LABEL_WRITE, signed, req.MAC) {
+		err = ErrAuthFailed.WithDetail("write for session %d", req.ID)
 		return
 	}
 
-	req = WriteRequest{
-		ID:                  binary.BigEndian.Uint64(msg[:8]),
-		FragmentationHeader: UnmarshalFragmentationHeader(binary.BigEndian.Uint16(msg[8:10])),
-		Data:                msg[10:],
+	req.Ack = DownstreamAck{
+		Next:   binary.BigEndian.Uint32(msg[8+MAC_SIZE : 8+MAC_SIZE+4]),
+		Bitmap: binary.BigEndian.Uint32(msg[8+MAC_SIZE+4 : 8+MAC_SIZE+8]),
+	}
+	req.Counter = binary.BigEndian.Uint32(msg[8+MAC_SIZE+8 : writeRequestFragmentStart])
+
+	fragment := msg[writeRequestFragmentStart:]
+	if upstream != nil {
+		fragment, err = upstream.Open(req.Counter, fragment)
+		if err != nil {
+			err = ErrAuthFailed.WithDetail("couldn't open write %d for session %d", req.Counter, req.ID)
+			return
+		}
+	}
+
+	fragHeader, n, err := UnmarshalFragmentationHeader(fragment)
+	if err != nil {
+		return
 	}
+
+	req.FragmentationHeader = fragHeader
+	req.Data = fragment[n:]
 	return
 }
 
-func (r WriteRequest) Marshal() []byte {
-	buff := make([]byte, 8+2+len(r.Data))
+// Upstream is the session's upstream cipher if it's encrypted, otherwise nil.
+// Every write needs a counter the session hasn't used before.
+func (r WriteRequest) Marshal(key []byte, upstream *DataCipher) []byte {
+	fragment := append(r.FragmentationHeader.Marshal(), r.Data...)
+	if upstream != nil {
+		fragment = upstream.Seal(r.Counter, fragment)
+	}
+
+	signed := make([]byte, 8+8+DATA_COUNTER_SIZE, 8+8+DATA_COUNTER_SIZE+len(fragment))
+	binary.BigEndian.PutUint64(signed[0:8], r.ID)
+	binary.BigEndian.PutUint32(signed[8:12], r.Ack.Next)
+	binary.BigEndian.PutUint32(signed[12:16], r.Ack.Bitmap)
+	binary.BigEndian.PutUint32(signed[16:20], r.Counter)
+	signed = append(signed, fragment...)
+
+	mac := computeMAC(key, MAC_LABEL_WRITE, signed)
+
 	// todo: rejig how i do some things
 	// so that this isn't a ctrl header session
-	binary.BigEndian.PutUint64(buff[0:8], r.ID)
-	binary.BigEndian.PutUint16(buff[8:10], r.FragmentationHeader.Marshal())
-	copy(buff[10:], r.Data)
-
+	buff := make([]byte, 0, len(signed)+MAC_SIZE)
+	buff = append(buff, signed[:8]...)
+	buff = append(buff, mac[:]...)
+	buff = append(buff, signed[8:]...)
 	return buff
 }
 
 // Response to writes
 type WriteResponse PollResponse
 
-func UnmarshalWriteResponse(msg []byte) (res WriteResponse, err error) {
-	wRes, err := UnmarshalPollResponse(msg)
+func UnmarshalWriteResponse(msg []byte, downstream *DataCipher) (res WriteResponse, err error) {
+	wRes, err := UnmarshalPollResponse(msg, downstream)
 	if err != nil {
 		return
 	}
@@ -205,6 +584,6 @@ func UnmarshalWriteResponse(msg []byte) (res WriteResponse, err error) {
 	return
 }
 
-func (r *WriteResponse) Marshal() []byte {
-	return (*PollResponse)(r).Marshal()
+func (r *WriteResponse) Marshal(downstream *DataCipher) []byte {
+	return (*PollResponse)(r).Marshal(downstream)
 }
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// One line of the ACL file:
+//
+//	allow|deny [key=name,name...] target
+//
+// where target is a CIDR, an IP, or a hostname pattern (like *.example.com, or * for anything),
+// optionally followed by :port, :low-high or :* (IPv6 addresses and CIDRs go in brackets if they have a port).
+type aclRule struct {
+	line  int
+	text  string
+	allow bool
+	// Empty for rules that apply to every key
+	keys []string
+	// Exactly one of these is set. Networks match the address we'd dial, patterns match the name the client asked for.
+	network *net.IPNet
+	pattern string
+	// Inclusive
+	portMin int
+	portMax int
+}
+
+// Decides where clients may ask us to dial. Rules are checked in order, the first one that matches wins,
+// and anything no rule matches is denied. Put deny rules for internal networks before allow rules for hostnames,
+// or a name that resolves to an internal address would get through.
+type ACL struct {
+	rules []aclRule
+}
+
+func parsePortRange(spec string) (min int, max int, err error) {
+	if spec == "*" {
+		return 1, 65535, nil
+	}
+
+	low, high, isRange := strings.Cut(spec, "-")
+	min, err = strconv.Atoi(low)
+	if err != nil {
+		return
+	}
+
+	max = min
+	if isRange {
+		max, err = strconv.Atoi(high)
+		if err != nil {
+			return
+		}
+	}
+
+	if min < 1 || max > 65535 || min > max {
+		err = fmt.Errorf("bad port range %s", spec)
+	}
+	return
+}
+
+// Splits the target into its host and port range, which defaults to every port
+func splitTarget(target string) (host string, portSpec string) {
+	portSpec = "*"
+
+	if strings.HasPrefix(target, "[") {
+		end := strings.Index(target, "]")
+		if end < 0 {
+			return target, portSpec
+		}
+		host = target[1:end]
+		if rest := target[end+1:]; strings.HasPrefix(rest, ":") {
+			portSpec = rest[1:]
+		}
+		return
+	}
+
+	// More than one colon without brackets is a bare IPv6 address
+	if strings.Count(target, ":") == 1 {
+		host, portSpec, _ = strings.Cut(target, ":")
+		return
+	}
+	return target, portSpec
+}
+
+func parseACLRule(line int, text string) (rule aclRule, err error) {
+	rule = aclRule{
+		line: line,
+		text: text,
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) < 2 || len(fields) > 3 {
+		err = fmt.Errorf("expected allow|deny [key=name,...] target")
+		return
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+		rule.allow = false
+	default:
+		err = fmt.Errorf("unknown action %s (must be allow or deny)", fields[0])
+		return
+	}
+
+	if len(fields) == 3 {
+		names := strings.TrimPrefix(fields[1], "key=")
+		if names == fields[1] || names == "" {
+			err = fmt.Errorf("expected key=name,... but got %s", fields[1])
+			return
+		}
+		rule.keys = strings.Split(names, ",")
+	}
+
+	host, portSpec := splitTarget(fields[len(fields)-1])
+
+	rule.portMin, rule.portMax, err = parsePortRange(portSpec)
+	if err != nil {
+		return
+	}
+
+	if strings.Contains(host, "/") {
+		_, rule.network, err = net.ParseCIDR(host)
+		return
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return
+	}
+
+	rule.pattern = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, err = path.Match(rule.pattern, ""); err != nil {
+		err = fmt.Errorf("bad hostname pattern %s", host)
+	}
+	return
+}
+
+// Blank lines and lines starting with # are skipped
+func readACL(aclPath string) (acl *ACL, err error) {
+	file, err := os.Open(aclPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	acl = &ACL{}
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseACLRule(lineNum, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", aclPath, lineNum, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Whether the rule is for keyName and port, which we can tell before the destination is resolved
+func (rule *aclRule) appliesTo(keyName string, port int) bool {
+	if len(rule.keys) > 0 {
+		found := false
+		for _, name := range rule.keys {
+			if name == keyName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return port >= rule.portMin && port <= rule.portMax
+}
+
+func (rule *aclRule) matchesHost(host string) bool {
+	matched, _ := path.Match(rule.pattern, host)
+	return matched
+}
+
+func (rule *aclRule) matches(keyName string, host string, addr *net.UDPAddr) bool {
+	if !rule.appliesTo(keyName, addr.Port) {
+		return false
+	}
+
+	if rule.network != nil {
+		return rule.network.Contains(addr.IP)
+	}
+	return rule.matchesHost(host)
+}
+
+func (rule *aclRule) reason() string {
+	return fmt.Sprintf("line %d: %s", rule.line, rule.text)
+}
+
+// Lowercased without the trailing dot, for matching against hostname patterns
+func normaliseHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Whether keyName may dial dest (what the client asked for), which resolved to addr.
+// Reason says which rule decided, for the audit log. A nil ACL allows everything.
+func (acl *ACL) Check(keyName string, dest string, addr *net.UDPAddr) (allowed bool, reason string) {
+	if acl == nil {
+		return true, "no ACL"
+	}
+
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	host = normaliseHost(host)
+
+	for i := range acl.rules {
+		rule := &acl.rules[i]
+		if rule.matches(keyName, host, addr) {
+			return rule.allow, rule.reason()
+		}
+	}
+
+	return false, "no rule matched"
+}
+
+// Like Check, but before dest is resolved, so clients can't have us look up names the ACL would never let them dial.
+// Network rules can't be checked without the address, but if none of them could change the outcome
+// (or dest is already an address), it's decided. Otherwise, it's up to Check once dest is resolved.
+// Ports are looked up locally, so they can be names like "domain".
+func (acl *ACL) CheckName(keyName string, dest string) (decided bool, allowed bool, reason string) {
+	if acl == nil {
+		return true, true, "no ACL"
+	}
+
+	host, portName, err := net.SplitHostPort(dest)
+	if err != nil {
+		return true, false, fmt.Sprintf("bad destination (%v)", err)
+	}
+	port, err := net.LookupPort("udp", portName)
+	if err != nil {
+		return true, false, fmt.Sprintf("bad destination (%v)", err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		allowed, reason = acl.Check(keyName, dest, &net.UDPAddr{IP: ip, Port: port})
+		return true, allowed, reason
+	}
+
+	host = normaliseHost(host)
+	allowed, reason = false, "no rule matched"
+	// Whether a network rule we had to skip over might allow or deny it
+	couldAllow, couldDeny := false, false
+
+	for i := range acl.rules {
+		rule := &acl.rules[i]
+		if !rule.appliesTo(keyName, port) {
+			continue
+		}
+
+		if rule.network == nil {
+			if rule.matchesHost(host) {
+				allowed, reason = rule.allow, rule.reason()
+				break
+			}
+			continue
+		}
+
+		if rule.allow {
+			couldAllow = true
+		} else {
+			couldDeny = true
+		}
+	}
+
+	if (allowed && couldDeny) || (!allowed && couldAllow) {
+		return false, false, ""
+	}
+
+	if couldAllow || couldDeny {
+		reason += " (without resolving it)"
+	}
+	return true, allowed, reason
+}
+
+func (acl *ACL) Len() int {
+	if acl == nil {
+		return 0
+	}
+	return len(acl.rules)
+}
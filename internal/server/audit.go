@@ -0,0 +1,33 @@
+package server
+
+import (
+	"log"
+	"os"
+)
+
+// Where access decisions go: who opened (or was refused) what, and why, and sessions closed by revocations.
+// It's the main log unless it's given a file of its own.
+type auditLog struct {
+	logger *log.Logger
+}
+
+func openAuditLog(path string) (audit *auditLog, err error) {
+	if path == "" {
+		return &auditLog{
+			logger: log.New(log.Writer(), "audit: ", log.Flags()),
+		}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	return &auditLog{
+		logger: log.New(file, "", log.LstdFlags|log.LUTC),
+	}, nil
+}
+
+func (a *auditLog) record(format string, args ...any) {
+	a.logger.Printf(format, args...)
+}
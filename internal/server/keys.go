@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// Reads a key file, which has a key per line: its name, then whitespace, then the passphrase (the rest of the line).
+// Blank lines and lines starting with # are skipped.
+func readKeyFile(path string) (keys *request.Keyring, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	keys = request.NewKeyring()
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.IndexAny(line, " \t")
+		if split < 0 || strings.TrimSpace(line[split:]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected a name and a passphrase", path, lineNum)
+		}
+
+		err = keys.Add(request.DeriveKey(line[:split], strings.TrimSpace(line[split:])))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// The keys from -pskFile if there is one, otherwise just -psk
+func (s *Server) loadKeys() (keys *request.Keyring, err error) {
+	if s.config.PSKFile != "" {
+		return readKeyFile(s.config.PSKFile)
+	}
+
+	keys = request.NewKeyring()
+	err = keys.Add(request.DeriveKey(request.DEFAULT_KEY_NAME, s.config.PSK))
+	return
+}
+
+func (s *Server) currentKeys() *request.Keyring {
+	return s.keys.Load().(*request.Keyring)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// What to throw away when a session's downstream queue is full
+type DropPolicy int
+
+const (
+	DROP_OLDEST   DropPolicy = iota // make room by dropping the fragments that have waited longest
+	DROP_NEWEST   DropPolicy = iota // drop incoming fragments that don't fit
+	DROP_DATAGRAM DropPolicy = iota // like DROP_OLDEST, but only ever whole datagrams, so nothing is left half-sent
+)
+
+var dropPolicyNames = map[string]DropPolicy{
+	"oldest":   DROP_OLDEST,
+	"newest":   DROP_NEWEST,
+	"datagram": DROP_DATAGRAM,
+}
+
+func ParseDropPolicy(name string) (policy DropPolicy, err error) {
+	policy, ok := dropPolicyNames[name]
+	if !ok {
+		err = fmt.Errorf("unknown drop policy %s (must be oldest, newest or datagram)", name)
+	}
+	return
+}
+
+type QueueStats struct {
+	Depth            int // fragments queued right now
+	PeakDepth        int
+	Enqueued         uint64 // fragments
+	Dropped          uint64 // fragments
+	DroppedDatagrams uint64 // datagrams that lost at least one fragment
+}
+
+// Fragments read off a session's socket, waiting for a poll to take them.
+// The feeder never blocks on it, so the destination's packets get dropped (and counted) here rather than in the kernel.
+type downstreamQueue struct {
+	lock      sync.Mutex
+	fragments []*request.PollResponse
+	depth     int
+	policy    DropPolicy
+	stats     QueueStats
+	// The last datagram we dropped part of, so a datagram is only counted once
+	lastDropped uint32
+	// Has something in it whenever fragments might be waiting
+	ready chan struct{}
+}
+
+func newDownstreamQueue(depth int, policy DropPolicy) *downstreamQueue {
+	if depth < 1 {
+		depth = 1
+	}
+
+	return &downstreamQueue{
+		depth:       depth,
+		policy:      policy,
+		lastDropped: request.MAX_FRAG_ID + 1, // not a valid ID
+		ready:       make(chan struct{}, 1),
+	}
+}
+
+// Must hold the lock
+func (q *downstreamQueue) countDrop(fragment *request.PollResponse) {
+	q.stats.Dropped++
+	if id := fragment.FragmentationHeader.ID; id != q.lastDropped {
+		q.lastDropped = id
+		q.stats.DroppedDatagrams++
+	}
+}
+
+// Drops the oldest datagram (or what's left of it). Must hold the lock.
+func (q *downstreamQueue) dropOldestDatagram() {
+	id := q.fragments[0].FragmentationHeader.ID
+	for len(q.fragments) > 0 && q.fragments[0].FragmentationHeader.ID == id {
+		q.countDrop(q.fragments[0])
+		q.fragments = q.fragments[1:]
+	}
+}
+
+// Queues up the fragments of one datagram, dropping whatever the policy says if they don't fit
+func (q *downstreamQueue) push(fragments []*request.PollResponse) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stats.Enqueued += uint64(len(fragments))
+
+	switch q.policy {
+	case DROP_OLDEST:
+		for _, fragment := range fragments {
+			if len(q.fragments) >= q.depth {
+				q.countDrop(q.fragments[0])
+				q.fragments = q.fragments[1:]
+			}
+			q.fragments = append(q.fragments, fragment)
+		}
+
+	case DROP_NEWEST:
+		for _, fragment := range fragments {
+			if len(q.fragments) >= q.depth {
+				q.countDrop(fragment)
+				continue
+			}
+			q.fragments = append(q.fragments, fragment)
+		}
+
+	case DROP_DATAGRAM:
+		if len(fragments) > q.depth {
+			// It would never fit, so there's no point dropping anything else for it
+			for _, fragment := range fragments {
+				q.countDrop(fragment)
+			}
+			break
+		}
+
+		for len(q.fragments)+len(fragments) > q.depth {
+			q.dropOldestDatagram()
+		}
+		q.fragments = append(q.fragments, fragments...)
+	}
+
+	if len(q.fragments) > q.stats.PeakDepth {
+		q.stats.PeakDepth = len(q.fragments)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the oldest fragment, or nil if there isn't one
+func (q *downstreamQueue) pop() (fragment *request.PollResponse) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.fragments) == 0 {
+		return nil
+	}
+
+	fragment = q.fragments[0]
+	q.fragments[0] = nil
+	q.fragments = q.fragments[1:]
+
+	// Pass the wakeup along, in case another poll is waiting
+	if len(q.fragments) > 0 {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	}
+
+	return
+}
+
+func (q *downstreamQueue) empty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.fragments) == 0
+}
+
+func (q *downstreamQueue) Stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := q.stats
+	stats.Depth = len(q.fragments)
+	return stats
+}
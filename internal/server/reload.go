@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// The ACL from -acl, or nil (which allows everything) if there isn't one
+func (s *Server) loadACL() (acl *ACL, err error) {
+	if s.config.ACLFile == "" {
+		return nil, nil
+	}
+	return readACL(s.config.ACLFile)
+}
+
+func (s *Server) currentACL() *ACL {
+	return s.acl.Load().(*ACL)
+}
+
+// Reloads the key file and ACL whenever we get a SIGHUP, so access can change without a restart.
+// Sessions opened with a key that's gone (or changed), or to somewhere the ACL no longer allows, are closed.
+func (s *Server) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		keys, err := s.loadKeys()
+		if err != nil {
+			log.Printf("Couldn't reload keys, keeping the old keys and ACL: %v", err)
+			continue
+		}
+
+		acl, err := s.loadACL()
+		if err != nil {
+			log.Printf("Couldn't reload ACL, keeping the old keys and ACL: %v", err)
+			continue
+		}
+
+		s.keys.Store(keys)
+		s.acl.Store(acl)
+		log.Printf("Reloaded %d keys and %d ACL rules", keys.Len(), acl.Len())
+
+		s.manager.store.each(func(sess *Session) {
+			reason := ""
+			if !keys.Has(sess.credential) {
+				reason = fmt.Sprintf("key %s was revoked", sess.credential.Name)
+			} else if allowed, rule := acl.Check(sess.credential.Name, sess.dest, sess.dialAddr); !allowed {
+				reason = fmt.Sprintf("ACL no longer allows %s (%s)", sess.dest, rule)
+			} else {
+				return
+			}
+
+			if _, ok := s.manager.removeSession(sess.id); ok {
+				s.audit.record("closed session %d for key %s to %s (%s): %s", sess.id, sess.credential.Name, sess.dest, sess.dialAddr, reason)
+				sess.Close(reason)
+			}
+		})
+	}
+}
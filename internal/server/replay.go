@@ -0,0 +1,128 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// How many counters behind the newest one we'll still accept, to allow for queries overtaking each other.
+// As in RFC 6479, the bitmap has a word more than the window, as the newest word gets recycled before it's full.
+const (
+	replayBitmapWords = 16
+	replayBitmapBits  = replayBitmapWords * 64
+	replayWindowSize  = replayBitmapBits - 64
+)
+
+// The most clients we'll keep windows for at once, which bounds how much memory replay protection takes.
+// Clients are forgotten once they've been quiet for twice AllowedClockSkew, as the timestamp check covers them from then on
+// (even if their clock is out by the most we allow).
+const maxReplayClients = 1 << 16
+
+// A sliding window over a client's control message counters (or a session's write counters), as in RFC 6479 (and WireGuard).
+// Bit n of the bitmap is for counters that are n mod replayBitmapBits.
+type replayWindow struct {
+	newest   uint64
+	bitmap   [replayBitmapWords]uint64
+	lastSeen time.Time
+}
+
+// Whether counter is new, without marking it
+func (w *replayWindow) fresh(counter uint64) bool {
+	if counter > w.newest {
+		return true
+	}
+	if w.newest-counter >= replayWindowSize {
+		return false
+	}
+
+	bit := counter % replayBitmapBits
+	return w.bitmap[bit/64]&(1<<(bit%64)) == 0
+}
+
+// Marks counter as seen, returning false if it already was (or it's fallen out of the window)
+func (w *replayWindow) mark(counter uint64) bool {
+	if !w.fresh(counter) {
+		return false
+	}
+
+	if counter > w.newest {
+		// Clear the words we're sliding over, as they're for counters from a lap ago
+		newWord := counter / 64
+		oldWord := w.newest / 64
+		for word := oldWord + 1; word <= newWord && word-oldWord <= replayBitmapWords; word++ {
+			w.bitmap[word%replayBitmapWords] = 0
+		}
+		w.newest = counter
+	}
+
+	bit := counter % replayBitmapBits
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+	return true
+}
+
+type replayClient struct {
+	keyID    request.KeyID
+	clientID uint64
+}
+
+type replayTracker struct {
+	lock    sync.Mutex
+	clients map[replayClient]*replayWindow
+}
+
+func newReplayTracker() *replayTracker {
+	return &replayTracker{
+		clients: make(map[replayClient]*replayWindow),
+	}
+}
+
+// A cheap check before we bother decrypting, so replays (or garbage copying a real header) don't cost a decryption.
+// It can't say yes for sure, as the same counter might get marked in the meantime.
+func (t *replayTracker) plausible(header request.ControlHeader) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	window, ok := t.clients[replayClient{header.KeyID, header.ClientID}]
+	return !ok || window.fresh(header.Counter)
+}
+
+// Records the message, once it's been decrypted (so only real clients take up space), returning an error if it's a replay
+func (t *replayTracker) accept(header request.ControlHeader) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	client := replayClient{header.KeyID, header.ClientID}
+	window, ok := t.clients[client]
+
+	if !ok {
+		if len(t.clients) >= maxReplayClients {
+			return request.ErrBusy.WithDetail("tracking too many clients to accept another")
+		}
+		window = &replayWindow{}
+		t.clients[client] = window
+	}
+
+	if !window.mark(header.Counter) {
+		return request.ErrReplay.WithDetail("control message replayed, or too far out of order")
+	}
+
+	window.lastSeen = time.Now()
+	return nil
+}
+
+// Forgets clients we haven't heard from in a while
+func (t *replayTracker) janitor() {
+	for {
+		time.Sleep(time.Minute)
+
+		t.lock.Lock()
+		for client, window := range t.clients {
+			if time.Since(window.lastSeen) > 2*AllowedClockSkew {
+				delete(t.clients, client)
+			}
+		}
+		t.lock.Unlock()
+	}
+}
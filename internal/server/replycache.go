@@ -0,0 +1,126 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// How long we remember replies for. Resolvers give up and retry well within this.
+const ReplyCacheTTL = 15 * time.Second
+
+// The most replies we'll remember at once, and how many bytes of them (counting their keys).
+// Past either, the oldest go first, so a flood of queries can't take up memory without bound.
+const (
+	ReplyCacheMaxEntries = 1 << 16
+	ReplyCacheMaxBytes   = 32 << 20
+)
+
+type cachedReply struct {
+	key      string
+	response []byte
+	ready    chan struct{}
+	expires  time.Time
+	size     int
+	element  *list.Element // nil once it's been removed
+}
+
+// Remembers the replies to recent queries, so retries get exactly the same answer
+type replyCache struct {
+	entries map[string]*cachedReply
+	order   *list.List // newest at the front, which is also the order they expire in
+	bytes   int
+	lock    sync.Mutex
+}
+
+func newReplyCache() *replyCache {
+	return &replyCache{
+		entries: make(map[string]*cachedReply),
+		order:   list.New(),
+	}
+}
+
+// Must hold the lock
+func (c *replyCache) remove(entry *cachedReply) {
+	if entry.element == nil {
+		return
+	}
+
+	c.order.Remove(entry.element)
+	entry.element = nil
+	c.bytes -= entry.size
+
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+}
+
+// Drops the oldest replies until we're back within our limits. Must hold the lock.
+func (c *replyCache) evict() {
+	for c.order.Len() > ReplyCacheMaxEntries || c.bytes > ReplyCacheMaxBytes {
+		c.remove(c.order.Back().Value.(*cachedReply))
+	}
+}
+
+// Returns the reply we gave for key, or handles it now if we haven't seen it.
+// If an identical query is still being handled, we wait for its reply rather than handling it twice.
+func (c *replyCache) get(key string, handle func() []byte) []byte {
+	c.lock.Lock()
+
+	entry, found := c.entries[key]
+	if found && time.Now().Before(entry.expires) {
+		c.lock.Unlock()
+		<-entry.ready
+		return entry.response
+	}
+
+	if found {
+		c.remove(entry)
+	}
+
+	entry = &cachedReply{
+		key:     key,
+		ready:   make(chan struct{}),
+		expires: time.Now().Add(ReplyCacheTTL),
+		size:    len(key),
+	}
+	entry.element = c.order.PushFront(entry)
+	c.entries[key] = entry
+	c.bytes += entry.size
+	c.evict()
+	c.lock.Unlock()
+
+	entry.response = handle()
+
+	c.lock.Lock()
+	// It might have been evicted while we were handling it, in which case it no longer counts
+	if entry.element != nil {
+		entry.size += len(entry.response)
+		c.bytes += len(entry.response)
+		c.evict()
+	}
+	c.lock.Unlock()
+
+	close(entry.ready)
+
+	return entry.response
+}
+
+func (c *replyCache) janitor() {
+	for {
+		time.Sleep(ReplyCacheTTL)
+
+		c.lock.Lock()
+
+		now := time.Now()
+		for c.order.Len() > 0 {
+			oldest := c.order.Back().Value.(*cachedReply)
+			if now.Before(oldest.expires) {
+				break
+			}
+			c.remove(oldest)
+		}
+
+		c.lock.Unlock()
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"strings"
+	"sync/atomic"
 	"time"
-	"crypto/sha256"
 
+	"github.com/lachlan2k/dns-tunnel/internal/records"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 	"github.com/miekg/dns"
 )
@@ -18,81 +20,161 @@ type Config struct {
 	Nameserver   string
 	PSK          string
 	PollOnWrite  bool
+	MaxUDPSize   int
+	// The longest we'll hold a poll open waiting for data, which should stay well under resolver timeouts
+	MaxPollWait time.Duration
+	// How long a session can go without hearing from its client before we close it
+	SessionTimeout time.Duration
+	// How many downstream fragments each session buffers for polls to pick up, and what to drop once it's full
+	QueueDepth int
+	DropPolicy string
+	// Named keys, one per line (see readKeyFile), used instead of PSK if it's set. Reloaded on SIGHUP.
+	PSKFile string
+	// Where clients may ask us to dial (see ACL), or anywhere if it's not set. Reloaded on SIGHUP.
+	ACLFile string
+	// Where access decisions are written, or the main log if it's not set
+	AuditLog string
 }
 
 type Server struct {
-	config  Config
-	manager SessionManager
+	config     Config
+	dropPolicy DropPolicy
+	manager    SessionManager
+	replies    *replyCache
+	keys       atomic.Value // *request.Keyring, use currentKeys()
+	acl        atomic.Value // *ACL, use currentACL()
+	audit      *auditLog
 }
 
 func NewFromConfig(config Config) (server *Server) {
 	server = &Server{
 		config: config,
 		manager: SessionManager{
-			store: make(map[uint64](*Session)),
-			seenRequestMap: make(map[[sha256.Size]byte](time.Time)),
+			store:   newSessionStore(),
+			replays: newReplayTracker(),
 		},
+		replies: newReplyCache(),
 	}
 	server.manager.server = server
 	return
 }
 
-func (s *Server) handleQuery(m *dns.Msg) {
-	for _, q := range m.Question {
-		switch q.Qtype {
-		case dns.TypeNS:
-			rr, _ := dns.NewRR(fmt.Sprintf("%s NS %s", q.Name, s.config.Nameserver))
-			m.Answer = append(m.Answer, rr)
+// Decodes and handles a tunnelled message, returning what to answer with.
+// Capacity is how many bytes the record type we're answering with can carry.
+func (s *Server) handleTunnelQuery(name string, capacity int) []byte {
+	upperName := strings.ToUpper(name)
+	msg := strings.TrimSuffix(upperName, strings.ToUpper(s.config.TunnelDomain))
 
-		case dns.TypeTXT:
-			upperName := strings.ToUpper(q.Name)
-			msg := strings.TrimSuffix(upperName, strings.ToUpper(s.config.TunnelDomain))
+	responseBytes, err := s.handleTunnelMessage(msg, capacity-request.RESPONSE_HEADER_SIZE)
+	if err != nil {
+		log.Printf("Handling error for %s: %v", msg, err)
 
-			msgBytes, err := request.DecodeRequest(msg)
+		// Anything we don't have a better code for is just a failure, without the details
+		res := request.ErrFailed
+		errors.As(err, &res)
+		return res.Marshal(capacity)
+	}
 
-			if err == nil && len(msgBytes) == 0 {
-				err = errors.New("0 length message received")
-			}
+	return request.OKResponse(responseBytes)
+}
 
-			if err != nil {
-				log.Printf("Decoding error for %s: %v", msg, err)
-				rr, _ := dns.NewRR(fmt.Sprintf("%s TXT no", q.Name))
-				m.Answer = append(m.Answer, rr)
-				continue
-			}
+func (s *Server) handleTunnelMessage(msg string, capacity int) (responseBytes []byte, err error) {
+	msgBytes, err := request.DecodeRequest(msg)
+	if err != nil {
+		err = request.ErrMalformed.WithDetail("couldn't decode: %v", err)
+		return
+	}
+
+	if len(msgBytes) == 0 {
+		err = request.ErrMalformed.WithDetail("0 length message received")
+		return
+	}
+
+	msgHeader := msgBytes[0]
+	msgBody := msgBytes[1:]
 
-			msgHeader := msgBytes[0]
-			msgBody := msgBytes[1:]
+	switch msgHeader {
+	case request.REQ_HEADER_CTRL:
+		var header request.ControlHeader
+		header, err = request.UnmarshalControlHeader(msgBody)
+		if err != nil {
+			return
+		}
 
-			var responseBytes []byte
+		if !s.manager.replays.plausible(header) {
+			err = request.ErrReplay.WithDetail("client %d message %d", header.ClientID, header.Counter)
+			return
+		}
 
-			switch msgHeader {
-			case request.REQ_HEADER_CTRL:
-				decryptedMsgBody, err := request.DecryptMessage(msgBody, s.config.PSK)
+		var decryptedMsgBody []byte
+		var key *request.Key
+		decryptedMsgBody, key, header, err = request.DecryptMessage(msgBody, s.currentKeys())
+		if err != nil {
+			return
+		}
 
-				if err != nil {
-					log.Printf("Decryption error for %s: %v", msg, err)
-					rr, _ := dns.NewRR(fmt.Sprintf("%s TXT no", q.Name))
-					m.Answer = append(m.Answer, rr)
-					continue
-				}
+		responseBytes, err = s.manager.handleControlMessage(decryptedMsgBody, key, header, capacity)
+	case request.REQ_HEADER_DATA:
+		// log.Printf("Handling data message %s as %s as %s", msg, hex.EncodeToString(msgBytes), msgBody)
+		if len(msgBody) < request.DATA_NONCE_SIZE {
+			err = request.ErrMalformed.WithDetail("data message too short")
+			return
+		}
+		responseBytes, err = s.manager.handleDataMessage(msgBody[request.DATA_NONCE_SIZE:], capacity)
+	case request.REQ_HEADER_TIME:
+		responseBytes, err = s.handleTimeProbe(msgBody)
+	default:
+		err = request.ErrMalformed.WithDetail("unrecognized message header %d", msgHeader)
+	}
 
-				responseBytes, err = s.manager.handleControlMessage(decryptedMsgBody, msgBody[0:24])
-			case request.REQ_HEADER_DATA:
-				// log.Printf("Handling data message %s as %s as %s", msg, hex.EncodeToString(msgBytes), msgBody)
-				responseBytes, err = s.manager.handleDataMessage(msgBody)
-			}
+	return
+}
+
+// Tells a client our time, signed under the key it asked for, so it can work out how far off its clock is
+func (s *Server) handleTimeProbe(msg []byte) (response []byte, err error) {
+	req, err := request.UnmarshalTimeProbeRequest(msg)
+	if err != nil {
+		return
+	}
+
+	key, ok := s.currentKeys().Get(req.KeyID)
+	if !ok {
+		err = request.ErrUnknownKey.WithDetail("key ID %d", req.KeyID)
+		return
+	}
+
+	response = request.TimeProbeResponse{
+		TimeMS: uint64(time.Now().UnixMilli()),
+	}.Marshal(key, req)
+	return
+}
+
+// msgSize is the largest response the resolver told us it can handle
+func (s *Server) handleQuery(m *dns.Msg, msgSize int) {
+	for _, q := range m.Question {
+		switch q.Qtype {
+		case dns.TypeNS:
+			rr, _ := dns.NewRR(fmt.Sprintf("%s NS %s", q.Name, s.config.Nameserver))
+			m.Answer = append(m.Answer, rr)
 
-			if err != nil {
-				log.Printf("Handling error for %s: %v", msg, err)
-				rr, _ := dns.NewRR(fmt.Sprintf("%s TXT sad", q.Name))
-				m.Answer = append(m.Answer, rr)
+		default:
+			codec, ok := records.GetCodec(q.Qtype)
+			if !ok {
 				continue
 			}
 
-			encodedResponse := request.EncodeResponse(responseBytes)
-			rr, _ := dns.NewRR(fmt.Sprintf("%s TXT %s", q.Name, encodedResponse))
-			m.Answer = append(m.Answer, rr)
+			// How much the record type we're answering with can carry
+			capacity := codec.Capacity(s.config.TunnelDomain, records.AnswerBudget(msgSize))
+
+			// Resolvers retry queries they think got lost, which we need to answer exactly the same way.
+			// Otherwise, a retried poll would take a fragment the first one already took, and writes would be fed twice.
+			// Names are case-insensitive, as resolvers may mix up the case on each attempt.
+			key := fmt.Sprintf("%d:%s", q.Qtype, strings.ToUpper(q.Name))
+			responseBytes := s.replies.get(key, func() []byte {
+				return s.handleTunnelQuery(q.Name, capacity)
+			})
+
+			m.Answer = append(m.Answer, codec.Encode(q.Name, s.config.TunnelDomain, responseBytes)...)
 
 			// fmt.Printf("ans: %s\n", m.Answer)
 		}
@@ -102,24 +184,78 @@ func (s *Server) handleQuery(m *dns.Msg) {
 func (s *Server) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Compress = false
+	// Multi-record answers repeat the question name in every record, so we need compression to keep them small
+	m.Compress = true
+
+	// Resolvers that support EDNS0 tell us how big a response they can take
+	msgSize := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		msgSize = int(opt.UDPSize())
+		if msgSize < dns.MinMsgSize {
+			msgSize = dns.MinMsgSize
+		}
+		if msgSize > s.config.MaxUDPSize {
+			msgSize = s.config.MaxUDPSize
+		}
+		m.SetEdns0(uint16(msgSize), false)
+	}
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		s.handleQuery(m)
+		s.handleQuery(m, msgSize)
+	}
+
+	// Anything that won't fit over UDP gets the TC bit, so the resolver retries over TCP
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		m.Truncate(msgSize)
 	}
 
 	w.WriteMsg(m)
 }
 
 func (s *Server) Run() (err error) {
+	s.dropPolicy, err = ParseDropPolicy(s.config.DropPolicy)
+	if err != nil {
+		return
+	}
+
+	keys, err := s.loadKeys()
+	if err != nil {
+		return
+	}
+	s.keys.Store(keys)
+
+	acl, err := s.loadACL()
+	if err != nil {
+		return
+	}
+	s.acl.Store(acl)
+
+	s.audit, err = openAuditLog(s.config.AuditLog)
+	if err != nil {
+		return
+	}
+
+	go s.reloadOnHangup()
+
 	s.config.TunnelDomain = dns.Fqdn(s.config.TunnelDomain)
 	dns.HandleFunc(s.config.TunnelDomain, s.handleDnsRequest)
-	dnsServer := &dns.Server{Addr: s.config.ListenAddr, Net: "udp"}
-	go s.manager.janitor()
+	go s.manager.replays.janitor()
+	go s.manager.reaper()
+	go s.replies.janitor()
+
+	log.Printf("Starting tunnel server (%s) on %s (udp and tcp) with %d keys and %d ACL rules\n", s.config.TunnelDomain, s.config.ListenAddr, keys.Len(), acl.Len())
+
+	errChan := make(chan error)
+	for _, network := range []string{"udp", "tcp"} {
+		dnsServer := &dns.Server{Addr: s.config.ListenAddr, Net: network}
+		go func() {
+			errChan <- dnsServer.ListenAndServe()
+		}()
+	}
 
-	log.Printf("Starting tunnel server (%s) on %s\n", s.config.TunnelDomain, s.config.ListenAddr)
-	err = dnsServer.ListenAndServe()
+	// If either listener dies, we die
+	err = <-errChan
 
 	return
 }
@@ -6,32 +6,94 @@ import (
 	"log"
 	"math"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lachlan2k/dns-tunnel/internal/fec"
 	"github.com/lachlan2k/dns-tunnel/internal/fragmentation"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 )
 
+// How long we wait for a downstream fragment to be acked before sending it again
+const RetransmitTimeout = 2 * time.Second
+
+type unackedFragment struct {
+	response *request.PollResponse
+	sentTime time.Time
+}
+
 type Session struct {
+	// When the client last polled or wrote (unix nanoseconds), so the reaper can find sessions nobody is using.
+	// It's first, so it's 64-bit aligned for atomics on 32-bit platforms.
+	lastPollTime int64
 	server       *Server
 	startTime    time.Time
-	lastPollTime time.Time
 	id           request.SessionID
+	key          []byte       // writes, polls and closes have to be MACed with this
+	credential   *request.Key // the pre-shared key the session was opened with
+	dest         string       // what the client asked us to dial, and what it resolved to, so the ACL can be checked again
+	dialAddr     *net.UDPAddr
 	conn         *net.UDPConn
-	fragTable    fragmentation.FragmentationTable
-	responseChan chan *request.PollResponse
-	fragId       uint16
+	fragTable    *fragmentation.FragmentationTable
+	queue        *downstreamQueue
+	fragId       uint32
+	closed       chan struct{}
+	closeOnce    sync.Once
+	// How many bytes of response the client's chosen record type can carry, updated on every query
+	responseCapacity int32
+	// The parity ratio the client asked for, which we raise as retransmits tell us fragments are going missing
+	fecRatio       float64
+	downstreamLoss fec.LossEstimator
+	// The largest datagram the client will take
+	maxDatagram int
+
+	// Only set if the client asked for encryption, in which case writes and poll responses are sealed with them
+	upstream   *request.DataCipher
+	downstream *request.DataCipher
+	// The write counters we've seen, so a write can't be replayed into the session once its packet is out of the fragment table
+	upstreamLock   sync.Mutex
+	upstreamWindow replayWindow
+
+	downstreamLock sync.Mutex
+	downstreamSeq  uint32
+	unacked        map[uint32]*unackedFragment
+	// How many more fragments of each FEC packet the client needs acked before it can rebuild it.
+	// Entries start when a packet's first fragment is sent, and go once none of its fragments are waiting on an ack.
+	fecNeeded map[uint32]int
+	// The packet we're taking fragments off the queue for
+	sendingId uint32
+
+	// How many dropped fragments the reaper has already told the logs about
+	reportedDrops uint64
 }
 
-func createAndDialSession(dialAddr *net.UDPAddr, server *Server) (sess *Session, err error) {
+// Caps are what we settled on with the client
+func createAndDialSession(dialAddr *net.UDPAddr, dest string, server *Server, credential *request.Key, capacity int, caps request.Capabilities, secret []byte) (sess *Session, err error) {
 	var idb [8]byte
 	rand.Read(idb[:])
+	id := binary.BigEndian.Uint64(idb[:])
 
 	sess = &Session{
-		server:       server,
-		id:           binary.BigEndian.Uint64(idb[:]),
-		fragTable:    fragmentation.NewFragTable(),
-		responseChan: make(chan *request.PollResponse),
+		server:      server,
+		id:          id,
+		key:         request.DeriveSessionKey(secret, id),
+		credential:  credential,
+		dest:        dest,
+		dialAddr:    dialAddr,
+		fragTable:   fragmentation.NewFragTable(fragmentation.DefaultLimits),
+		queue:       newDownstreamQueue(server.config.QueueDepth, server.dropPolicy),
+		closed:      make(chan struct{}),
+		unacked:     make(map[uint32]*unackedFragment),
+		fecNeeded:   make(map[uint32]int),
+		sendingId:   request.MAX_FRAG_ID + 1, // not a valid ID
+		fecRatio:    caps.FECRatio,
+		maxDatagram: caps.MaxDatagram,
+	}
+	sess.setResponseCapacity(capacity)
+
+	if caps.Encrypted() {
+		sess.upstream, sess.downstream = request.NewDataCiphers(secret, id)
 	}
 
 	err = sess.Open(dialAddr)
@@ -53,13 +115,81 @@ func (sess *Session) Open(dialAddr *net.UDPAddr) (err error) {
 	}
 
 	sess.startTime = time.Now()
-	sess.lastPollTime = sess.startTime
+	sess.lastPollTime = sess.startTime.UnixNano()
 
 	return
 }
 
+// Stops the feeder and lets go of the socket. Reason is just for the logs.
+func (sess *Session) Close(reason string) {
+	sess.closeOnce.Do(func() {
+		close(sess.closed)
+		sess.conn.Close()
+
+		log.Printf("Session %d ended after %v (%s), reassembly stats: %+v, queue stats: %+v", sess.id, time.Since(sess.startTime).Round(time.Second), reason, sess.fragTable.Stats(), sess.queue.Stats())
+	})
+}
+
+// Logs how the downstream queue is coping, if it's dropped anything since we last asked, so the depth can be sized
+func (sess *Session) reportDrops() {
+	stats := sess.queue.Stats()
+	if stats.Dropped == sess.reportedDrops {
+		return
+	}
+
+	log.Printf("Session %d has dropped %d downstream fragments since the last report (queue stats: %+v)", sess.id, stats.Dropped-sess.reportedDrops, stats)
+	sess.reportedDrops = stats.Dropped
+}
+
+func (sess *Session) touch() {
+	atomic.StoreInt64(&sess.lastPollTime, time.Now().UnixNano())
+}
+
+func (sess *Session) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sess.lastPollTime)))
+}
+
+func (sess *Session) isClosed() bool {
+	select {
+	case <-sess.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sess *Session) encrypted() bool {
+	return sess.downstream != nil
+}
+
+// Encrypted responses use their sequence number as the nonce, so once we've used them all, the session has to be replaced
+func (sess *Session) exhausted() bool {
+	if !sess.encrypted() {
+		return false
+	}
+
+	sess.downstreamLock.Lock()
+	defer sess.downstreamLock.Unlock()
+	return sess.downstreamSeq == math.MaxUint32
+}
+
+// Marks a write's counter as seen, returning an error if it already was (or it's too far behind the newest)
+func (sess *Session) acceptCounter(counter uint32) error {
+	sess.upstreamLock.Lock()
+	defer sess.upstreamLock.Unlock()
+
+	if !sess.upstreamWindow.mark(uint64(counter)) {
+		return request.ErrReplay.WithDetail("write %d for session %d replayed, or too far out of order", counter, sess.id)
+	}
+	return nil
+}
+
+func (sess *Session) setResponseCapacity(capacity int) {
+	atomic.StoreInt32(&sess.responseCapacity, int32(capacity))
+}
+
 func (sess *Session) feeder() {
-	buff := make([]byte, 65507)
+	buff := make([]byte, request.MAX_DATAGRAM_SIZE)
 
 	for {
 		n, err := sess.conn.Read(buff)
@@ -67,88 +197,267 @@ func (sess *Session) feeder() {
 		copy(data, buff[:n])
 
 		if err != nil {
+			if sess.isClosed() {
+				return
+			}
 			continue
 		}
 
-		chunkSize := request.GetMaxResponseSize()
-		chunkCount := int(math.Ceil(float64(n) / float64(chunkSize)))
+		if n > sess.maxDatagram {
+			log.Printf("Dropping datagram for session %d: larger than the client will take (%d > %d bytes)", sess.id, n, sess.maxDatagram)
+			continue
+		}
 
-		id := sess.fragId
-		sess.fragId++
+		// MAX_FRAG_ID is all ones, and the counter wraps around at a multiple of it
+		id := (atomic.AddUint32(&sess.fragId, 1) - 1) & request.MAX_FRAG_ID
 
-		for i := 0; i < chunkCount; i++ {
-			start := chunkSize * i
-			end := chunkSize * (i + 1)
-			if end > n {
-				end = n
+		chunkSize := request.GetMaxResponseSize(int(atomic.LoadInt32(&sess.responseCapacity)), sess.encrypted())
+		parityRatio := fec.ParityRatio(sess.fecRatio, sess.downstreamLoss.Loss())
+
+		fragments, err := fragmentation.Split(data, id, chunkSize, parityRatio)
+		if err != nil {
+			log.Printf("Dropping datagram for session %d: %v", sess.id, err)
+			continue
+		}
+
+		responses := make([]*request.PollResponse, len(fragments))
+		for i, fragment := range fragments {
+			responses[i] = &request.PollResponse{
+				Status:              request.POLL_OK,
+				FragmentationHeader: fragment.Header,
+				Data:                fragment.Data,
 			}
+		}
 
-			if sess.fragId > request.MAX_FRAG_ID {
-				sess.fragId = 0
+		sess.queue.push(responses)
+	}
+}
+
+// Whether we can send a new sequence number, without getting too far ahead of the client's acks
+func (sess *Session) windowOpen() bool {
+	if len(sess.unacked) == 0 {
+		return true
+	}
+
+	oldest := sess.downstreamSeq
+	for seq := range sess.unacked {
+		if int32(seq-oldest) < 0 {
+			oldest = seq
+		}
+	}
+
+	return sess.downstreamSeq-oldest < request.DOWNSTREAM_WINDOW
+}
+
+// Picks what to send next: a fragment that's due for a resend, otherwise the oldest queued fragment (if the window allows).
+// If there's nothing to send, canTakeMore says whether the caller should wait on the queue.
+func (sess *Session) nextDownstream() (res *request.PollResponse, canTakeMore bool) {
+	sess.downstreamLock.Lock()
+	defer sess.downstreamLock.Unlock()
+
+	now := time.Now()
+	var due *unackedFragment
+
+	for _, fragment := range sess.unacked {
+		if now.Sub(fragment.sentTime) < RetransmitTimeout {
+			continue
+		}
+		if due == nil || int32(fragment.response.Seq-due.response.Seq) < 0 {
+			due = fragment
+		}
+	}
+
+	if due != nil {
+		due.sentTime = now
+		// Skips only stand in for fragments the client didn't need, so they don't say anything about loss
+		if due.response.Status != request.POLL_SKIP {
+			sess.downstreamLoss.Record(true)
+		}
+		return due.response, false
+	}
+
+	if !sess.windowOpen() {
+		return nil, false
+	}
+
+	if sess.encrypted() && sess.downstreamSeq == math.MaxUint32 {
+		// Out of nonces, see exhausted()
+		return nil, false
+	}
+
+	res = sess.popQueued()
+	if res == nil {
+		return nil, true
+	}
+
+	res.Seq = sess.downstreamSeq
+	sess.downstreamSeq++
+	sess.unacked[res.Seq] = &unackedFragment{
+		response: res,
+		sentTime: now,
+	}
+
+	return
+}
+
+// Takes the next queued fragment worth sending, dropping the rest of any FEC packet the client can already rebuild.
+// Must hold downstreamLock.
+func (sess *Session) popQueued() *request.PollResponse {
+	for {
+		res := sess.queue.pop()
+		if res == nil {
+			return nil
+		}
+
+		header := res.FragmentationHeader
+		if header.ID != sess.sendingId {
+			// The feeder queues a packet's fragments all together, so this is a new packet, even if it's reusing an old one's ID
+			sess.sendingId = header.ID
+			delete(sess.fecNeeded, header.ID)
+			if header.DataCount > 0 {
+				sess.fecNeeded[header.ID] = int(header.DataCount)
 			}
+			return res
+		}
+
+		if needed, ok := sess.fecNeeded[header.ID]; ok && needed <= 0 {
+			continue
+		}
+		return res
+	}
+}
+
+func (sess *Session) ack(ack request.DownstreamAck) {
+	sess.downstreamLock.Lock()
+	defer sess.downstreamLock.Unlock()
+
+	var finished []uint32
+
+	for seq, fragment := range sess.unacked {
+		if !ack.Acks(seq) {
+			continue
+		}
+
+		delete(sess.unacked, seq)
+		if fragment.response.Status == request.POLL_SKIP {
+			continue
+		}
+		sess.downstreamLoss.Record(false)
 
-			res := &request.PollResponse{
-				Status: request.POLL_OK,
-				FragmentationHeader: request.FragmentationHeader{
-					ID:              id,
-					Index:           uint8(i),
-					IsFinalFragment: i == (chunkCount - 1),
-				},
-				Data: data[start:end],
+		id := fragment.response.FragmentationHeader.ID
+		if needed, ok := sess.fecNeeded[id]; ok && needed > 0 {
+			sess.fecNeeded[id] = needed - 1
+			if needed == 1 {
+				finished = append(finished, id)
 			}
+		}
+	}
+
+	for _, id := range finished {
+		sess.skipRest(id)
+	}
 
-			sess.responseChan <- res
+	if len(sess.fecNeeded) == 0 {
+		return
+	}
+
+	// Forget packets that are done with, so an ID that comes around again starts from scratch
+	live := map[uint32]bool{sess.sendingId: true}
+	for _, fragment := range sess.unacked {
+		if fragment.response.Status == request.POLL_OK {
+			live[fragment.response.FragmentationHeader.ID] = true
+		}
+	}
+	for id := range sess.fecNeeded {
+		if !live[id] {
+			delete(sess.fecNeeded, id)
 		}
 	}
 }
 
-func (sess *Session) Poll() []byte {
-	sess.lastPollTime = time.Now()
+// The client can rebuild FEC packet id from what it's acked, so whatever it hasn't acked yet doesn't need sending again.
+// We still have to send something under their sequence numbers for the client's acks to move past them,
+// so they're swapped for skips, which are much smaller. Whatever's still queued gets dropped by popQueued.
+// Must hold downstreamLock.
+func (sess *Session) skipRest(id uint32) {
+	for seq, fragment := range sess.unacked {
+		header := fragment.response.FragmentationHeader
+		if fragment.response.Status == request.POLL_OK && header.DataCount > 0 && header.ID == id {
+			fragment.response = &request.PollResponse{
+				Status: request.POLL_SKIP,
+				Seq:    seq,
+			}
+		}
+	}
+}
 
-	var res *request.PollResponse
+// How often a held poll checks whether a fragment has come due for a resend (or acks have opened the window)
+const pollCheckInterval = 250 * time.Millisecond
 
-	select {
-	case <-time.After(100 * time.Millisecond):
+// Waits up to wait for something to send, so idle clients don't have to keep asking
+func (sess *Session) Poll(wait time.Duration) []byte {
+	sess.touch()
+	deadline := time.Now().Add(wait)
+
+	res, canTakeMore := sess.nextDownstream()
+
+	for res == nil {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if remaining > pollCheckInterval {
+			remaining = pollCheckInterval
+		}
+
+		if canTakeMore {
+			select {
+			case <-time.After(remaining):
+			case <-sess.queue.ready:
+			}
+		} else {
+			time.Sleep(remaining)
+		}
+
+		res, canTakeMore = sess.nextDownstream()
+	}
+
+	if res == nil {
 		res = &request.PollResponse{
 			Status: request.POLL_NO_DATA,
 		}
-	case res = <-sess.responseChan:
 	}
 
-	return res.Marshal()
+	return res.Marshal(sess.downstream)
 }
 
-func (sess *Session) Write(req request.WriteRequest) []byte {
-	sess.lastPollTime = time.Now()
+func (sess *Session) Write(req request.WriteRequest) (response []byte, err error) {
+	sess.touch()
 	// log.Printf("Ingesting fragment for session %d: %v", sess.id, req)
 
 	completePacket, err := sess.fragTable.FeedFragment(req.FragmentationHeader, req.Data)
 	if err != nil {
-		log.Printf("Error feeding packet fragment: %v", err)
-		res := request.WriteResponse{
-			Status: request.POLL_ERROR,
-		}
-		return res.Marshal()
+		err = request.ErrMalformed.WithDetail("couldn't feed fragment: %v", err)
+		return
 	}
 
 	if completePacket != nil {
 		// log.Printf("reconstructed complete packet: %v", completePacket)
-		_, err := sess.conn.Write(completePacket)
+		_, err = sess.conn.Write(completePacket)
 		if err != nil {
 			log.Printf("write failed (sess %d): %v", sess.id, err)
-			res := request.WriteResponse{
-				Status: request.POLL_ERROR,
-			}
-			return res.Marshal()
+			err = request.ErrFailed.WithDetail("couldn't deliver datagram")
+			return
 		}
 	}
 
+	// Writes are answered straight away, but we can give them anything that's already waiting
 	if sess.server.config.PollOnWrite {
-		return sess.Poll()
+		return sess.Poll(0), nil
 	}
 
 	res := request.WriteResponse{
 		Status: request.POLL_NO_DATA,
 	}
-	return res.Marshal()
+	return res.Marshal(sess.downstream), nil
 }
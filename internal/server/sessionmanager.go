@@ -1,110 +1,192 @@
 package server
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net"
-	"sync"
 	"time"
 
+	"github.com/lachlan2k/dns-tunnel/internal/records"
 	"github.com/lachlan2k/dns-tunnel/internal/request"
 )
 
 const AllowedClockSkew = 5 * time.Minute
 
+// How often we look for sessions that have gone quiet
+const SessionReapInterval = 30 * time.Second
+
 type SessionManager struct {
-	store  map[request.SessionID](*Session)
+	store  *sessionStore
 	server *Server
-	// The seen request map is to prevent replay-attacks, or issues when a resolver sends a request twice.
-	// We keep track of all session open requests' sha256sums, and look for something we've seen before, and drop it if we have.
-	// The janitor clears out any that run out of time
-	seenRequestMap map[[sha256.Size]byte](time.Time)
-	requestMapLock sync.Mutex
+	// Stops control messages being replayed (or handled twice if a resolver sends a query again)
+	replays *replayTracker
 }
 
 func (mgr *SessionManager) getSession(id request.SessionID) (sess *Session, ok bool) {
-	sess, ok = mgr.store[id]
-	return
+	return mgr.store.get(id)
 }
 
-func (mgr *SessionManager) storeSession(sess *Session) {
-	mgr.store[sess.id] = sess
+func (mgr *SessionManager) removeSession(id request.SessionID) (sess *Session, ok bool) {
+	return mgr.store.remove(id)
 }
 
-func (mgr *SessionManager) janitor() {
+func (mgr *SessionManager) reaper() {
 	for {
-		mgr.requestMapLock.Lock()
+		time.Sleep(SessionReapInterval)
+		mgr.reap()
+	}
+}
 
-		now := time.Now()
-		for checksum, seenTime := range mgr.seenRequestMap {
-			if now.After(seenTime.Add(AllowedClockSkew)) {
-				delete(mgr.seenRequestMap, checksum)
-			}
+// Closes sessions the client hasn't polled or written to in a while, as it's probably gone for good
+func (mgr *SessionManager) reap() {
+	mgr.store.each(func(sess *Session) {
+		idle := sess.idleTime()
+		if idle <= mgr.server.config.SessionTimeout {
+			sess.fragTable.Expire()
+			sess.reportDrops()
+			return
 		}
 
-		mgr.requestMapLock.Unlock()
-		time.Sleep(time.Minute)
-	}
+		if _, ok := mgr.removeSession(sess.id); ok {
+			sess.Close(fmt.Sprintf("idle for %v", idle.Round(time.Second)))
+		}
+	})
 }
 
-func (mgr *SessionManager) checkReplay(timestamp time.Time, msg []byte) error {
-	mgr.requestMapLock.Lock()
-	defer mgr.requestMapLock.Unlock()
-
+func (mgr *SessionManager) checkReplay(timestamp time.Time, header request.ControlHeader) error {
 	now := time.Now()
 	if timestamp.After(now.Add(AllowedClockSkew)) || timestamp.Before(now.Add(-AllowedClockSkew)) {
-		return errors.New("session open request clock skew error -- possible replay attack, or incorrect time on server/client")
+		// A distinct code, so the client knows to sync its clock rather than just giving up
+		return request.ErrClockSkew.WithDetail("off by %v", timestamp.Sub(now).Round(time.Second))
 	}
 
-	checksum := sha256.Sum256(msg)
-	_, found := mgr.seenRequestMap[checksum]
+	return mgr.replays.accept(header)
+}
+
+func (mgr *SessionManager) handleOpen(msg []byte, key *request.Key, capacity int) (response []byte, err error) {
+	log.Printf("Received new session request with key %s\n", key.Name)
 
-	if found {
-		return errors.New("request open collision detected (possible replay attack, or resolver being funky)")
+	req, err := request.UnmarshalSessionOpenRequest(msg)
+	if err != nil {
+		return
 	}
 
-	mgr.seenRequestMap[checksum] = timestamp
+	res, err := mgr.openSession(req, key, capacity)
+	if err != nil {
+		return
+	}
 
-	return nil
+	response = res.Marshal()
+	return
 }
 
-func (mgr *SessionManager) handleOpen(msg []byte) (response []byte, err error) {
-	log.Printf("Received new session request\n")
+// Like handleOpen, but the secret comes out of the handshake instead of the request, and the response goes back in it
+func (mgr *SessionManager) handleHandshake(msg []byte, key *request.Key, capacity int) (response []byte, err error) {
+	log.Printf("Received new session handshake with key %s\n", key.Name)
+
+	hs := request.NewHandshake(key, false)
+
+	req, err := request.UnmarshalSessionHandshakeRequest(msg, hs)
+	if err != nil {
+		return
+	}
 
-	req := request.UnmarshalSessionOpenRequest(msg)
+	req.Secret, err = hs.Accept()
+	if err != nil {
+		return
+	}
+
+	res, err := mgr.openSession(req, key, capacity)
+	if err != nil {
+		return
+	}
+
+	response, err = res.MarshalHandshake(hs)
+	return
+}
+
+// Key is the one the client opened the session with, so the session can be closed if it's revoked
+func (mgr *SessionManager) openSession(req request.SessionOpenRequest, key *request.Key, capacity int) (res request.SessionOpenResponse, err error) {
+	settled, err := request.Settle(req.Capabilities, serverCapabilities())
+	if err != nil {
+		return
+	}
+
+	// Whatever the ACL can decide without resolving the name, it does, so it doesn't get resolved for nothing
+	acl := mgr.server.currentACL()
+	decided, allowed, rule := acl.CheckName(key.Name, req.DestAddr)
+	if decided && !allowed {
+		mgr.server.audit.record("denied key %s to %s: %s", key.Name, req.DestAddr, rule)
+		res = request.SessionOpenResponse{
+			Status: request.SESSION_OPEN_DENIED,
+		}
+		return
+	}
 
 	dialAddr, err := net.ResolveUDPAddr("udp", req.DestAddr)
 	if err != nil {
+		mgr.server.audit.record("denied key %s to %s: couldn't resolve it (%v)", key.Name, req.DestAddr, err)
+		err = request.ErrFailed.WithDetail("couldn't resolve %s", req.DestAddr)
 		return
 	}
 
-	log.Printf("Request to dial udp://%s", dialAddr)
+	log.Printf("Request to dial udp://%s (%s)", dialAddr, settled)
 
-	sess, err := createAndDialSession(dialAddr, mgr.server)
+	if !decided {
+		allowed, rule = acl.Check(key.Name, req.DestAddr, dialAddr)
+	}
+	if !allowed {
+		mgr.server.audit.record("denied key %s to %s (%s): %s", key.Name, req.DestAddr, dialAddr, rule)
+		res = request.SessionOpenResponse{
+			Status: request.SESSION_OPEN_DENIED,
+		}
+		return
+	}
+
+	sess, err := createAndDialSession(dialAddr, req.DestAddr, mgr.server, key, capacity, settled, req.Secret)
 	if err != nil {
 		log.Printf("Unable to dial %s: %v", req.DestAddr, err)
+		mgr.server.audit.record("allowed key %s to %s (%s) but dial failed: %v: %s", key.Name, req.DestAddr, dialAddr, err, rule)
 		err = nil
-		response = request.SessionOpenResponse{
+		res = request.SessionOpenResponse{
 			Status: request.SESSION_OPEN_DIAL_FAIL,
-		}.Marshal()
+		}
 		return
-	} else {
-		log.Printf("Opened session %d to %s", sess.id, dialAddr)
 	}
 
-	mgr.storeSession(sess)
+	if !mgr.store.put(sess) {
+		// Two random 64-bit IDs colliding is about as likely as it gets
+		sess.Close("session ID already taken")
+		mgr.server.audit.record("allowed key %s to %s (%s) but session ID %d was already taken: %s", key.Name, req.DestAddr, dialAddr, sess.id, rule)
+		err = request.ErrFailed.WithDetail("session ID %d already taken", sess.id)
+		return
+	}
 
-	response = request.SessionOpenResponse{
-		Status: request.SESSION_OPEN_OK,
-		ID:     sess.id,
-	}.Marshal()
+	log.Printf("Opened session %d to %s for key %s (%d sessions open)", sess.id, dialAddr, key.Name, mgr.store.len())
+	mgr.server.audit.record("allowed key %s to %s (%s) as session %d: %s", key.Name, req.DestAddr, dialAddr, sess.id, rule)
 
+	res = request.SessionOpenResponse{
+		Status:       request.SESSION_OPEN_OK,
+		ID:           sess.id,
+		Capabilities: settled,
+	}
 	return
 }
 
-func (mgr *SessionManager) handlePoll(msg []byte) (response []byte, err error) {
+// Everything we can do, for settling on what a session will use
+func serverCapabilities() request.Capabilities {
+	return request.Capabilities{
+		Encodings:   []uint8{request.ENCODING_BASE32HEX},
+		RecordTypes: records.Types(),
+		MaxDatagram: request.MAX_DATAGRAM_SIZE,
+		FECRatio:    math.MaxUint8 / 100.0,
+		Encryption:  []uint8{request.ENCRYPTION_CHACHA20POLY1305, request.ENCRYPTION_NONE},
+	}
+}
+
+func (mgr *SessionManager) handlePoll(msg []byte, capacity int) (response []byte, err error) {
 	req, err := request.UnmarshalPollRequest(msg)
 	if err != nil {
 		return
@@ -113,37 +195,113 @@ func (mgr *SessionManager) handlePoll(msg []byte) (response []byte, err error) {
 	sess, ok := mgr.getSession(req.ID)
 
 	if !ok {
-		response = request.PollResponse{
-			Status: request.RES_HEADER_CLOSED,
-		}.Marshal()
+		err = request.ErrUnknownSession.WithDetail("session %d", req.ID)
+		return
+	}
+
+	if !req.Authentic(sess.key) {
+		err = request.ErrAuthFailed.WithDetail("poll for session %d", req.ID)
+		return
+	}
+
+	if mgr.retireIfExhausted(sess) {
+		err = request.ErrUnknownSession.WithDetail("session %d ran out of sequence numbers", req.ID)
 		return
 	}
 
-	response = sess.Poll()
+	wait := time.Duration(req.WaitMS) * time.Millisecond
+	if wait > mgr.server.config.MaxPollWait {
+		wait = mgr.server.config.MaxPollWait
+	}
+
+	sess.setResponseCapacity(capacity)
+	sess.ack(req.Ack)
+	response = sess.Poll(wait)
 	return
 }
 
-func (mgr *SessionManager) handleWrite(msg []byte) (response []byte, err error) {
-	req, err := request.UnmarshalWriteRequest(msg)
+func (mgr *SessionManager) handleWrite(msg []byte, capacity int) (response []byte, err error) {
+	id, err := request.WriteRequestSessionID(msg)
+	if err != nil {
+		return
+	}
+
+	sess, ok := mgr.getSession(id)
+	if !ok {
+		err = request.ErrUnknownSession.WithDetail("session %d", id)
+		return
+	}
+
+	// Checks the MAC before anything reaches the fragmentation table, or counts as activity
+	req, err := request.UnmarshalWriteRequest(msg, sess.key, sess.upstream)
+	if err != nil {
+		return
+	}
+
+	// Only once it's authentic, so forgeries can't use up counters
+	err = sess.acceptCounter(req.Counter)
+	if err != nil {
+		return
+	}
+
+	if mgr.retireIfExhausted(sess) {
+		err = request.ErrUnknownSession.WithDetail("session %d ran out of sequence numbers", id)
+		return
+	}
+
+	sess.setResponseCapacity(capacity)
+	sess.ack(req.Ack)
+	return sess.Write(req)
+}
+
+// Closes an encrypted session that's run out of nonces, so the client opens a new one (with new keys) in its place
+func (mgr *SessionManager) retireIfExhausted(sess *Session) bool {
+	if !sess.exhausted() {
+		return false
+	}
+
+	if _, ok := mgr.removeSession(sess.id); ok {
+		sess.Close("ran out of sequence numbers")
+	}
+	return true
+}
+
+func (mgr *SessionManager) handleClose(msg []byte) (response []byte, err error) {
+	req, err := request.UnmarshalSessionCloseRequest(msg)
 	if err != nil {
 		return
 	}
 
 	sess, ok := mgr.getSession(req.ID)
 	if !ok {
-		response = request.PollResponse{
-			Status: request.RES_HEADER_CLOSED,
-		}.Marshal()
+		err = request.ErrUnknownSession.WithDetail("session %d", req.ID)
+		return
+	}
+
+	if !req.Authentic(sess.key) {
+		err = request.ErrAuthFailed.WithDetail("close for session %d", req.ID)
 		return
 	}
 
-	response = sess.Write(req)
+	// It might have been reaped (or closed by a resolver's retry) in the meantime
+	if _, ok := mgr.removeSession(req.ID); !ok {
+		err = request.ErrUnknownSession.WithDetail("session %d", req.ID)
+		return
+	}
+
+	sess.Close("closed by client")
+
+	response = request.SessionCloseResponse{
+		Status: request.SESSION_CLOSE_OK,
+	}.Marshal()
 	return
 }
 
-func (mgr *SessionManager) handleControlMessage(msg []byte, nonce []byte) (response []byte, err error) {
+// Capacity is how many response bytes the record type of the query can carry
+// Key and header are what the message was encrypted under
+func (mgr *SessionManager) handleControlMessage(msg []byte, key *request.Key, header request.ControlHeader, capacity int) (response []byte, err error) {
 	if len(msg) < 10 {
-		err = errors.New("received unusually small control channel message")
+		err = request.ErrMalformed.WithDetail("received unusually small control channel message")
 		return
 	}
 
@@ -152,11 +310,7 @@ func (mgr *SessionManager) handleControlMessage(msg []byte, nonce []byte) (respo
 	headerByte := msg[8]
 	data := msg[9:]
 
-	dataToCheck := make([]byte, len(nonce)+len(msg))
-	copy(dataToCheck[:len(nonce)], nonce)
-	copy(dataToCheck[len(nonce):], msg)
-
-	err = mgr.checkReplay(time.UnixMilli(int64(timestamp)), dataToCheck)
+	err = mgr.checkReplay(time.UnixMilli(int64(timestamp)), header)
 
 	if err != nil {
 		return
@@ -164,17 +318,21 @@ func (mgr *SessionManager) handleControlMessage(msg []byte, nonce []byte) (respo
 
 	switch headerByte {
 	case request.CTRL_HEADER_SESSION_OPEN:
-		response, err = mgr.handleOpen(data)
+		response, err = mgr.handleOpen(data, key, capacity)
+	case request.CTRL_HEADER_SESSION_HANDSHAKE:
+		response, err = mgr.handleHandshake(data, key, capacity)
 	case request.CTRL_HEADER_SESSION_POLL:
-		response, err = mgr.handlePoll(data)
+		response, err = mgr.handlePoll(data, capacity)
+	case request.CTRL_HEADER_SESSION_CLOSE:
+		response, err = mgr.handleClose(data)
 	default:
-		err = errors.New("unrecognized header byte")
+		err = request.ErrMalformed.WithDetail("unrecognized control header %d", headerByte)
 	}
 
 	return
 }
 
-func (mgr *SessionManager) handleDataMessage(msg []byte) (response []byte, err error) {
-	response, err = mgr.handleWrite(msg)
+func (mgr *SessionManager) handleDataMessage(msg []byte, capacity int) (response []byte, err error) {
+	response, err = mgr.handleWrite(msg, capacity)
 	return
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// Session IDs are random, so the low bits spread them evenly over the shards
+const sessionStoreShards = 64
+
+type sessionShard struct {
+	lock     sync.RWMutex
+	sessions map[request.SessionID]*Session
+}
+
+// Every query looks up its session, so we split the store into shards with their own locks,
+// and queries for different sessions rarely wait on each other
+type sessionStore struct {
+	shards [sessionStoreShards]sessionShard
+}
+
+func newSessionStore() *sessionStore {
+	store := &sessionStore{}
+	for i := range store.shards {
+		store.shards[i].sessions = make(map[request.SessionID]*Session)
+	}
+	return store
+}
+
+func (s *sessionStore) shard(id request.SessionID) *sessionShard {
+	return &s.shards[id%sessionStoreShards]
+}
+
+func (s *sessionStore) get(id request.SessionID) (sess *Session, ok bool) {
+	shard := s.shard(id)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	sess, ok = shard.sessions[id]
+	return
+}
+
+// Stores sess, unless its ID is already taken, returning whether it was stored
+func (s *sessionStore) put(sess *Session) bool {
+	shard := s.shard(sess.id)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if _, taken := shard.sessions[sess.id]; taken {
+		return false
+	}
+	shard.sessions[sess.id] = sess
+	return true
+}
+
+// Takes the session out of the store, and returns it if it was there.
+// Only one caller gets ok for any session, so only one of them should close it.
+func (s *sessionStore) remove(id request.SessionID) (sess *Session, ok bool) {
+	shard := s.shard(id)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	sess, ok = shard.sessions[id]
+	delete(shard.sessions, id)
+	return
+}
+
+// Calls fn on every session, one shard at a time.
+// fn runs without any locks held, so it's free to remove sessions.
+func (s *sessionStore) each(fn func(sess *Session)) {
+	var sessions []*Session
+
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.lock.RLock()
+		sessions = sessions[:0]
+		for _, sess := range shard.sessions {
+			sessions = append(sessions, sess)
+		}
+		shard.lock.RUnlock()
+
+		for _, sess := range sessions {
+			fn(sess)
+		}
+	}
+}
+
+func (s *sessionStore) len() (n int) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		n += len(shard.sessions)
+		shard.lock.RUnlock()
+	}
+	return
+}
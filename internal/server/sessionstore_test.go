@@ -0,0 +1,280 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/dns-tunnel/internal/request"
+)
+
+// These are meant to be run with -race, which is what catches most of what they're for
+
+func TestSessionStoreConcurrent(t *testing.T) {
+	const workers = 32
+	const perWorker = 500
+
+	store := newSessionStore()
+	var removed int64
+
+	// Walks the store the whole time, like the reaper, taking some sessions out from under the workers
+	stop := make(chan struct{})
+	var walker sync.WaitGroup
+	walker.Add(1)
+	go func() {
+		defer walker.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			store.each(func(sess *Session) {
+				if sess.id%7 != 0 {
+					return
+				}
+				if _, ok := store.remove(sess.id); ok {
+					atomic.AddInt64(&removed, 1)
+				}
+			})
+			store.len()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < perWorker; i++ {
+				sess := &Session{id: request.SessionID(w*perWorker + i)}
+				if !store.put(sess) {
+					t.Errorf("couldn't store session %d", sess.id)
+					return
+				}
+
+				if got, ok := store.get(sess.id); ok && got != sess {
+					t.Errorf("got a different session back for %d", sess.id)
+				}
+
+				if _, ok := store.remove(sess.id); ok {
+					atomic.AddInt64(&removed, 1)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	walker.Wait()
+
+	if removed != workers*perWorker {
+		t.Errorf("removed %d sessions, expected each of the %d to be removed exactly once", removed, workers*perWorker)
+	}
+	if n := store.len(); n != 0 {
+		t.Errorf("%d sessions left in the store", n)
+	}
+}
+
+func TestSessionStoreOneWinner(t *testing.T) {
+	const racers = 64
+	store := newSessionStore()
+
+	var stored, removed int64
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.put(&Session{id: 42}) {
+				atomic.AddInt64(&stored, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := store.remove(42); ok {
+				atomic.AddInt64(&removed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stored != 1 || removed != 1 {
+		t.Errorf("stored %d times and removed %d times, expected once each", stored, removed)
+	}
+}
+
+// A server with just enough set up to open sessions, with its logs thrown away
+func newTestServer(t *testing.T, sessionTimeout time.Duration) *Server {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+	})
+
+	server := NewFromConfig(Config{
+		SessionTimeout: sessionTimeout,
+		MaxPollWait:    time.Second,
+		QueueDepth:     16,
+	})
+	server.acl.Store((*ACL)(nil))
+
+	var err error
+	server.audit, err = openAuditLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// Sends everything it gets back where it came from, until the test is over
+func echoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	go func() {
+		buff := make([]byte, request.MAX_DATAGRAM_SIZE)
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buff[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// The reaper can close a session between any two of its queries, which the client would see as an unknown session
+func gone(err error) bool {
+	return errors.Is(err, request.ErrUnknownSession)
+}
+
+// Opens, writes to, polls and closes sessions from many goroutines at once, while the reaper closes idle ones
+func TestSessionManagerConcurrent(t *testing.T) {
+	const workers = 32
+	const perWorker = 100
+	const capacity = 200
+
+	server := newTestServer(t, 20*time.Millisecond)
+	mgr := &server.manager
+	dest := echoServer(t).String()
+	key := request.DeriveKey("test", "test")
+
+	caps := request.DefaultCapabilities()
+
+	stop := make(chan struct{})
+	var reaper sync.WaitGroup
+	reaper.Add(1)
+	go func() {
+		defer reaper.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				mgr.reap()
+			}
+		}
+	}()
+
+	var opened []*Session
+	var openedLock sync.Mutex
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < perWorker; i++ {
+				secret, err := request.NewSessionSecret()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				res, err := mgr.openSession(request.SessionOpenRequest{
+					Capabilities: caps,
+					Secret:       secret,
+					DestAddr:     dest,
+				}, key, capacity)
+				if err != nil || res.Status != request.SESSION_OPEN_OK {
+					t.Errorf("couldn't open session (status %d): %v", res.Status, err)
+					return
+				}
+
+				if sess, ok := mgr.getSession(res.ID); ok {
+					openedLock.Lock()
+					opened = append(opened, sess)
+					openedLock.Unlock()
+				}
+
+				sessionKey := request.DeriveSessionKey(secret, res.ID)
+
+				write := request.WriteRequest{
+					ID:                  res.ID,
+					FragmentationHeader: request.FragmentationHeader{IsFinalFragment: true},
+					Data:                []byte("hello"),
+				}
+				if _, err := mgr.handleWrite(write.Marshal(sessionKey, nil), capacity); err != nil && !gone(err) {
+					t.Errorf("write to session %d failed: %v", res.ID, err)
+				}
+
+				poll := request.PollRequest{ID: res.ID}
+				for p := 0; p < 3; p++ {
+					if _, err := mgr.handlePoll(poll.Marshal(sessionKey)[1:], capacity); err != nil && !gone(err) {
+						t.Errorf("poll for session %d failed: %v", res.ID, err)
+					}
+				}
+
+				// Leave some for the reaper
+				if i%4 == 0 {
+					continue
+				}
+
+				closeReq := request.SessionCloseRequest{ID: res.ID}
+				if _, err := mgr.handleClose(closeReq.Marshal(sessionKey)[1:]); err != nil && !gone(err) {
+					t.Errorf("close for session %d failed: %v", res.ID, err)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	reaper.Wait()
+
+	// Everything left has gone idle by now
+	time.Sleep(50 * time.Millisecond)
+	mgr.reap()
+
+	if n := mgr.store.len(); n != 0 {
+		t.Errorf("%d sessions still open", n)
+	}
+
+	for _, sess := range opened {
+		if !sess.isClosed() {
+			t.Errorf("session %d was removed without being closed", sess.id)
+		}
+	}
+}